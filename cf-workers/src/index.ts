@@ -4,6 +4,21 @@ import { connect } from "cloudflare:sockets";
 
 const app = new Hono();
 
+// sendError tells the browser why the tunnel is closed, in the control
+// message format of the Go proxy (package/server/control.go). status and
+// error keep older clients working.
+function sendError(ws: { send(data: string): void }, code: string, message: string) {
+  ws.send(
+    JSON.stringify({
+      type: "error",
+      code,
+      message,
+      status: "failed",
+      error: message,
+    }),
+  );
+}
+
 app.get(
   "/ws/:host/:port",
   upgradeWebSocket((c) => {
@@ -22,7 +37,8 @@ app.get(
             setTimeout(async () => {
               const opened = await sock?.opened;
               if (!opened) {
-                ws.close();
+                sendError(ws, "dial_timeout", "the target did not answer in time");
+                ws.close(1011, "dial timeout");
                 console.log({
                   status: "failed",
                   remote: { host, port },
@@ -48,12 +64,8 @@ app.get(
               }
             })();
           } catch (e) {
-            const res = JSON.stringify({
-              status: "failed",
-              error: (e as Error).message,
-            });
-            ws.send(res);
-            ws.close();
+            sendError(ws, "dial_failed", (e as Error).message);
+            ws.close(1011, "dial failed");
           }
         } else {
           const data = new Uint8Array(ev.data);
@@ -3,9 +3,12 @@ module github.com/wrtx-dev/gowasmssh
 go 1.23.3
 
 require (
+	github.com/gorilla/websocket v1.5.3
 	github.com/pkg/sftp v1.13.9
 	golang.org/x/crypto v0.41.0
 	golang.org/x/net v0.43.0
+	golang.org/x/time v0.12.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,196 @@
+//go:build js && wasm
+// +build js,wasm
+
+package js
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Error codes of the proxy's control messages, see
+// package/server/control.go.
+const (
+	ErrCodeBadRequest     = "bad_request"
+	ErrCodeUnauthorized   = "unauthorized"
+	ErrCodePolicyDenied   = "policy_denied"
+	ErrCodeRateLimited    = "rate_limited"
+	ErrCodeTooManyTunnels = "too_many_tunnels"
+	ErrCodeShuttingDown   = "shutting_down"
+	ErrCodeUnknownTarget  = "unknown_target"
+	ErrCodeDialBlocked    = "dial_blocked"
+	ErrCodeDialTimeout    = "dial_timeout"
+	ErrCodeDialRefused    = "dial_refused"
+	ErrCodeDialDNS        = "dial_dns"
+	ErrCodeDialUpstream   = "dial_upstream"
+	ErrCodeDialFailed     = "dial_failed"
+	ErrCodeIdleTimeout    = "idle_timeout"
+	ErrCodeMaxLifetime    = "max_lifetime"
+	ErrCodeTerminated     = "terminated"
+	ErrCodeTunnelError    = "tunnel_error"
+	ErrCodeHostKeyChanged = "host_key_changed"
+	ErrCodeNotSSH         = "not_ssh"
+)
+
+// Errors a ProxyError matches with errors.Is, by its code.
+var (
+	ErrBadRequest     = errors.New("bad request")
+	ErrUnauthorized   = errors.New("unauthorized")
+	ErrPolicyDenied   = errors.New("destination not allowed")
+	ErrRateLimited    = errors.New("rate limited")
+	ErrTooManyTunnels = errors.New("too many tunnels")
+	ErrShuttingDown   = errors.New("proxy shutting down")
+	ErrUnknownTarget  = errors.New("unknown target")
+	ErrDialBlocked    = errors.New("target address blocked")
+	ErrDialTimeout    = errors.New("target timed out")
+	ErrDialRefused    = errors.New("target refused the connection")
+	ErrDialDNS        = errors.New("target host not found")
+	ErrDialUpstream   = errors.New("upstream proxy failed")
+	ErrDialFailed     = errors.New("target unreachable")
+	ErrIdleTimeout    = errors.New("idle timeout")
+	ErrMaxLifetime    = errors.New("maximum lifetime reached")
+	ErrTerminated     = errors.New("closed by an administrator")
+	ErrTunnelError    = errors.New("tunnel error")
+	ErrHostKeyChanged = errors.New("target host key changed")
+	ErrNotSSH         = errors.New("not an SSH connection")
+)
+
+var proxyErrors = map[string]error{
+	ErrCodeBadRequest:     ErrBadRequest,
+	ErrCodeUnauthorized:   ErrUnauthorized,
+	ErrCodePolicyDenied:   ErrPolicyDenied,
+	ErrCodeRateLimited:    ErrRateLimited,
+	ErrCodeTooManyTunnels: ErrTooManyTunnels,
+	ErrCodeShuttingDown:   ErrShuttingDown,
+	ErrCodeUnknownTarget:  ErrUnknownTarget,
+	ErrCodeDialBlocked:    ErrDialBlocked,
+	ErrCodeDialTimeout:    ErrDialTimeout,
+	ErrCodeDialRefused:    ErrDialRefused,
+	ErrCodeDialDNS:        ErrDialDNS,
+	ErrCodeDialUpstream:   ErrDialUpstream,
+	ErrCodeDialFailed:     ErrDialFailed,
+	ErrCodeIdleTimeout:    ErrIdleTimeout,
+	ErrCodeMaxLifetime:    ErrMaxLifetime,
+	ErrCodeTerminated:     ErrTerminated,
+	ErrCodeTunnelError:    ErrTunnelError,
+	ErrCodeHostKeyChanged: ErrHostKeyChanged,
+	ErrCodeNotSSH:         ErrNotSSH,
+}
+
+// ProxyError is the reason the proxy gave in a control message before it
+// closed the connection. It matches the Err values of its code with
+// errors.Is and unwraps to the CloseError that followed it.
+type ProxyError struct {
+	Code    string
+	Message string
+	// RetryAfter is how long to wait before trying again, zero when the
+	// proxy did not say.
+	RetryAfter time.Duration
+	// Close is the close that followed, nil until it arrived.
+	Close *CloseError
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy: %s (%s)", e.Message, e.Code)
+}
+
+func (e *ProxyError) Is(target error) bool {
+	return proxyErrors[e.Code] == target && target != nil
+}
+
+func (e *ProxyError) Unwrap() error {
+	if e.Close == nil {
+		return nil
+	}
+	return e.Close
+}
+
+// controlMessage is the JSON of a control message. Status and Error are
+// the older form the Cloudflare worker sent, {"status":"failed","error":...}.
+type controlMessage struct {
+	Type       string `json:"type"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after"`
+	CloseIn    int    `json:"close_in"`
+	Status     string `json:"status"`
+	Error      string `json:"error"`
+}
+
+// Draining is the notice the proxy sends open connections when it starts
+// shutting down. They keep working until they end or CloseIn passed.
+type Draining struct {
+	Message string
+	// CloseIn is how long the proxy keeps the connection open at most.
+	CloseIn time.Duration
+}
+
+// parseDraining returns the notice of a draining control message, nil when
+// it is not one.
+func parseDraining(data []byte) *Draining {
+	var msg controlMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "draining" {
+		return nil
+	}
+	return &Draining{Message: msg.Message, CloseIn: time.Duration(msg.CloseIn) * time.Second}
+}
+
+// drainWatch hands the draining notice of a connection to the function
+// registered with OnDraining, whichever of the two comes first.
+type drainWatch struct {
+	mu     sync.Mutex
+	notice *Draining
+	notify func(*Draining)
+}
+
+func (d *drainWatch) set(notice *Draining) {
+	d.mu.Lock()
+	if d.notice != nil {
+		d.mu.Unlock()
+		return
+	}
+	d.notice = notice
+	notify := d.notify
+	d.mu.Unlock()
+	if notify != nil {
+		go notify(notice)
+	}
+}
+
+// OnDraining sets f to be called once the proxy announces it is shutting
+// down, right away if it already did.
+func (d *drainWatch) OnDraining(f func(*Draining)) {
+	d.mu.Lock()
+	d.notify = f
+	notice := d.notice
+	d.mu.Unlock()
+	if notice != nil {
+		go f(notice)
+	}
+}
+
+// parseControl returns the error a control message reports, nil when it is
+// not one.
+func parseControl(data []byte) *ProxyError {
+	var msg controlMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil
+	}
+	switch {
+	case msg.Type == "error":
+		return &ProxyError{
+			Code:       msg.Code,
+			Message:    msg.Message,
+			RetryAfter: time.Duration(msg.RetryAfter) * time.Second,
+		}
+	case msg.Status == "failed":
+		if len(msg.Error) == 0 {
+			msg.Error = "the target could not be reached"
+		}
+		return &ProxyError{Code: ErrCodeDialFailed, Message: msg.Error}
+	}
+	return nil
+}
@@ -0,0 +1,471 @@
+//go:build js && wasm
+// +build js,wasm
+
+package js
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MuxProtocol is the WebSocket subprotocol that carries many streams over
+// one WebSocket to the proxy, the wire format is described in
+// package/server/mux.go.
+const MuxProtocol = "gowasmssh.mux.v1"
+
+const (
+	muxOpen   = 1
+	muxOpened = 2
+	muxData   = 3
+	muxWindow = 4
+	muxClose  = 5
+	muxError  = 6
+
+	muxHeaderSize = 9
+	muxMaxPayload = 32 << 10
+	muxWindowSize = 256 << 10
+
+	// muxRetryAfter is how long a proxy the mux WebSocket could not be
+	// opened to is not tried again, the failure may be transient.
+	muxRetryAfter = 30 * time.Second
+)
+
+// ErrMuxUnavailable is returned by DialMux when no multiplexed session can
+// be set up with the proxy, e.g. because it predates the protocol. Dial
+// still works then.
+var ErrMuxUnavailable = errors.New("ws: multiplexing unavailable")
+
+var muxSessions struct {
+	sync.Mutex
+	sessions map[string]*muxSession
+	// dialing holds the session dial in flight to a proxy, later dials to
+	// it wait for that one instead of opening their own.
+	dialing map[string]*muxDial
+	// unavailable remembers proxies a session could not be set up with, so
+	// every later dial does not try again first.
+	unavailable map[string]muxFailure
+}
+
+// muxFailure is why no session could be set up with a proxy. until is
+// zero when the proxy does not speak the protocol, then it is not tried
+// again.
+type muxFailure struct {
+	err   error
+	until time.Time
+}
+
+// DialMux opens a stream to host:port over the multiplexed WebSocket to the
+// proxy at proxy, e.g. wss://example.com/ws. The WebSocket is opened on
+// first use and shared by all streams to the same proxy.
+func DialMux(ctx context.Context, proxy, host string, port int, ticket string) (net.Conn, error) {
+	return dialMux(ctx, proxy, muxOpenRequest{Host: host, Port: port, Ticket: ticket})
+}
+
+// DialMuxTarget is DialMux to the target the proxy's catalog calls name.
+func DialMuxTarget(ctx context.Context, proxy, name, ticket string) (net.Conn, error) {
+	return dialMux(ctx, proxy, muxOpenRequest{Target: name, Ticket: ticket})
+}
+
+// muxOpenRequest is the payload of an open frame.
+type muxOpenRequest struct {
+	Target string `json:"target,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Ticket string `json:"ticket,omitempty"`
+}
+
+func dialMux(ctx context.Context, proxy string, req muxOpenRequest) (net.Conn, error) {
+	m, err := muxSessionTo(ctx, proxy)
+	if err != nil {
+		return nil, err
+	}
+	return m.open(ctx, req)
+}
+
+// muxDial is a session dial in flight, done is closed once err is set.
+type muxDial struct {
+	done chan struct{}
+	err  error
+}
+
+// muxSessionTo returns the session to proxy, opening it when there is none.
+// Callers arriving during the handshake wait for it and share its outcome,
+// unless it failed because the dialing caller's context ended. The lock is
+// not held while dialing, dials to other proxies go ahead meanwhile.
+func muxSessionTo(ctx context.Context, proxy string) (*muxSession, error) {
+	for {
+		muxSessions.Lock()
+		if m := muxSessions.sessions[proxy]; m != nil {
+			muxSessions.Unlock()
+			return m, nil
+		}
+		if f, ok := muxSessions.unavailable[proxy]; ok {
+			if f.until.IsZero() || time.Now().Before(f.until) {
+				muxSessions.Unlock()
+				return nil, f.err
+			}
+			delete(muxSessions.unavailable, proxy)
+		}
+		if d := muxSessions.dialing[proxy]; d != nil {
+			muxSessions.Unlock()
+			select {
+			case <-d.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if d.err != nil && !errors.Is(d.err, context.Canceled) && !errors.Is(d.err, context.DeadlineExceeded) {
+				return nil, d.err
+			}
+			continue
+		}
+		d := &muxDial{done: make(chan struct{})}
+		if muxSessions.dialing == nil {
+			muxSessions.dialing = make(map[string]*muxDial)
+		}
+		muxSessions.dialing[proxy] = d
+		muxSessions.Unlock()
+
+		m, until, err := dialMuxSession(ctx, proxy)
+		muxSessions.Lock()
+		delete(muxSessions.dialing, proxy)
+		switch {
+		case err == nil:
+			if muxSessions.sessions == nil {
+				muxSessions.sessions = make(map[string]*muxSession)
+			}
+			muxSessions.sessions[proxy] = m
+			go m.readLoop()
+		case ctx.Err() != nil:
+			err = ctx.Err()
+		default:
+			err = fmt.Errorf("%w: %v", ErrMuxUnavailable, err)
+			if muxSessions.unavailable == nil {
+				muxSessions.unavailable = make(map[string]muxFailure)
+			}
+			muxSessions.unavailable[proxy] = muxFailure{err: err, until: until}
+		}
+		d.err = err
+		close(d.done)
+		muxSessions.Unlock()
+		return m, err
+	}
+}
+
+// dialMuxSession opens the mux WebSocket to proxy. On failure until is when
+// to try again, zero when the proxy does not speak the protocol.
+func dialMuxSession(ctx context.Context, proxy string) (m *muxSession, until time.Time, err error) {
+	ws, err := dial(ctx, proxy+"/mux", []string{MuxProtocol})
+	if err != nil {
+		return nil, time.Now().Add(muxRetryAfter), err
+	}
+	if ws.Protocol() != MuxProtocol {
+		ws.Close()
+		return nil, time.Time{}, errors.New("proxy selected no subprotocol")
+	}
+	return &muxSession{
+		proxy:   proxy,
+		ws:      ws,
+		streams: make(map[uint32]*MuxConn),
+		nextID:  1,
+	}, time.Time{}, nil
+}
+
+type muxSession struct {
+	proxy string
+	ws    *WsConn
+	wmu   sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*MuxConn
+	nextID  uint32
+	err     error
+}
+
+func (m *muxSession) open(ctx context.Context, req muxOpenRequest) (net.Conn, error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	}
+	c := &MuxConn{m: m, id: m.nextID, window: muxWindowSize, ready: make(chan struct{})}
+	c.cond = sync.NewCond(&c.mu)
+	m.nextID++
+	m.streams[c.id] = c
+	m.mu.Unlock()
+
+	payload, _ := json.Marshal(req)
+	if err := m.writeFrame(muxOpen, c.id, payload); err != nil {
+		m.remove(c.id)
+		return nil, err
+	}
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, fmt.Errorf("ws.dial: %w", c.err)
+	}
+	return c, nil
+}
+
+func (m *muxSession) readLoop() {
+	err := m.read()
+	m.ws.Close()
+	muxSessions.Lock()
+	if muxSessions.sessions[m.proxy] == m {
+		delete(muxSessions.sessions, m.proxy)
+	}
+	muxSessions.Unlock()
+	m.mu.Lock()
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*MuxConn)
+	m.mu.Unlock()
+	for _, c := range streams {
+		c.fail(err)
+	}
+}
+
+func (m *muxSession) read() error {
+	var hdr [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(m.ws, hdr[:]); err != nil {
+			return err
+		}
+		typ, id, n := hdr[0], binary.BigEndian.Uint32(hdr[1:5]), binary.BigEndian.Uint32(hdr[5:9])
+		if n > muxMaxPayload {
+			return fmt.Errorf("ws: mux frame of %d bytes", n)
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(m.ws, payload); err != nil {
+			return err
+		}
+		m.mu.Lock()
+		c := m.streams[id]
+		m.mu.Unlock()
+		if c == nil {
+			continue
+		}
+		switch typ {
+		case muxOpened:
+			c.readyOnce.Do(func() { close(c.ready) })
+		case muxData:
+			c.push(payload)
+		case muxWindow:
+			if n == 4 {
+				c.credit(int(binary.BigEndian.Uint32(payload)))
+			}
+		case muxError:
+			if notice := parseDraining(payload); notice != nil {
+				c.drainWatch.set(notice)
+			} else if pe := parseControl(payload); pe != nil {
+				c.control(pe)
+			}
+		case muxClose:
+			if n >= 2 {
+				c.remoteClose(int(binary.BigEndian.Uint16(payload)), string(payload[2:]))
+			}
+		}
+	}
+}
+
+func (m *muxSession) remove(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, id)
+}
+
+func (m *muxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[muxHeaderSize:], payload)
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	_, err := m.ws.Write(frame)
+	return err
+}
+
+// MuxConn is one stream of a multiplexed WebSocket.
+type MuxConn struct {
+	m         *muxSession
+	id        uint32
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	consumed int
+	window   int
+	err      error
+	// closeErr is why the proxy closed the stream or the session, ctl the
+	// error it reported before.
+	closeErr  *CloseError
+	ctl       *ProxyError
+	closeSent bool
+	drainWatch
+}
+
+func (c *MuxConn) push(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.buf.Write(p)
+		c.cond.Broadcast()
+	}
+}
+
+func (c *MuxConn) credit(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.window += n
+	c.cond.Broadcast()
+}
+
+func (c *MuxConn) control(pe *ProxyError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctl == nil {
+		c.ctl = pe
+	}
+}
+
+func (c *MuxConn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+		errors.As(err, &c.closeErr)
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.readyOnce.Do(func() { close(c.ready) })
+}
+
+// remoteClose ends the stream on the proxy's close frame and answers it.
+func (c *MuxConn) remoteClose(code int, reason string) {
+	ce := &CloseError{Code: code, Reason: reason}
+	var err error = ce
+	c.mu.Lock()
+	if c.ctl != nil {
+		c.ctl.Close = ce
+		err = c.ctl
+	}
+	c.mu.Unlock()
+	c.fail(err)
+	c.sendClose(code)
+	c.m.remove(c.id)
+}
+
+func (c *MuxConn) sendClose(code int) {
+	c.mu.Lock()
+	sent := c.closeSent
+	c.closeSent = true
+	c.mu.Unlock()
+	if !sent {
+		c.m.writeFrame(muxClose, c.id, binary.BigEndian.AppendUint16(nil, uint16(code)))
+	}
+}
+
+// CloseError returns the close code and reason once the proxy has closed
+// the stream, nil otherwise.
+func (c *MuxConn) CloseError() *CloseError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeErr
+}
+
+// ProxyError returns the error the proxy reported before closing the
+// stream, nil if it reported none.
+func (c *MuxConn) ProxyError() *ProxyError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ctl
+}
+
+func (c *MuxConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	for c.buf.Len() == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+	if c.buf.Len() == 0 {
+		err := c.err
+		c.mu.Unlock()
+		return 0, err
+	}
+	n, _ := c.buf.Read(b)
+	c.consumed += n
+	var credit int
+	if c.consumed >= muxWindowSize/2 {
+		credit, c.consumed = c.consumed, 0
+	}
+	c.mu.Unlock()
+	if credit != 0 {
+		c.m.writeFrame(muxWindow, c.id, binary.BigEndian.AppendUint32(nil, uint32(credit)))
+	}
+	return n, nil
+}
+
+func (c *MuxConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) != 0 {
+		c.mu.Lock()
+		for c.window == 0 && c.err == nil {
+			c.cond.Wait()
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+		n := min(len(b), c.window, muxMaxPayload)
+		c.window -= n
+		c.mu.Unlock()
+		if err := c.m.writeFrame(muxData, c.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *MuxConn) Close() error {
+	c.sendClose(1000)
+	c.fail(net.ErrClosed)
+	c.m.remove(c.id)
+	return nil
+}
+
+func (c *MuxConn) LocalAddr() net.Addr {
+	return wsAddr{}
+}
+
+func (c *MuxConn) RemoteAddr() net.Addr {
+	return wsAddr{}
+}
+
+func (c *MuxConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *MuxConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *MuxConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
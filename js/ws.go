@@ -17,7 +17,7 @@ import (
 
 var script = `return new Promise(function(resolve, reject){
 	var resolved = false;
-	var s = new WebSocket(addr);
+	var s = new WebSocket(addr, protocols);
 	s.binaryType = 'arraybuffer';
 	s.onerror = (e) => {
 		console.log("websocket error");
@@ -41,6 +41,10 @@ var script = `return new Promise(function(resolve, reject){
 		event(2, e);
 	}
 	s.onmessage = (m) => {
+		if (typeof m.data === "string") {
+			event(4, m.data);
+			return;
+		}
 		event(3, new Uint8Array(m.data));
 	}
 })`
@@ -56,6 +60,50 @@ type WsConn struct {
 	mu  sync.Mutex
 	buf bytes.Buffer
 	err error
+	// ctl is the error the proxy reported in a control message.
+	ctl *ProxyError
+	drainWatch
+}
+
+// Close codes the proxy uses when it ends a session on its own.
+const (
+	CloseGoingAway   = 1001
+	CloseIdleTimeout = 4001
+	CloseMaxLifetime = 4002
+	CloseTerminated  = 4003
+	// CloseHostKeyChanged means the proxy saw the target present another
+	// SSH host key than the one it knows.
+	CloseHostKeyChanged = 4004
+	// CloseNotSSH means the target or the client did not speak SSH where
+	// the proxy only relays SSH.
+	CloseNotSSH = 4005
+)
+
+// CloseError is returned once the WebSocket has been closed, it carries the
+// close code and reason sent by the proxy.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if len(e.Reason) != 0 {
+		return fmt.Sprintf("ws: connection closed with code %d: %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("ws: connection closed with code %d", e.Code)
+}
+
+// Expired reports whether the proxy closed the session because of its idle
+// timeout or maximum lifetime.
+func (e *CloseError) Expired() bool {
+	return e.Code == CloseIdleTimeout || e.Code == CloseMaxLifetime
+}
+
+// ServerClosed reports whether the proxy ended the session on its own,
+// because it expired, an administrator closed it, the target's host key
+// changed or the proxy is shutting down.
+func (e *CloseError) ServerClosed() bool {
+	return e.Expired() || e.Code == CloseGoingAway || e.Code == CloseTerminated || e.Code == CloseHostKeyChanged
 }
 
 type jsevent struct {
@@ -63,7 +111,7 @@ type jsevent struct {
 	Data  JsValue
 }
 
-func (ws *WsConn) openSocket(addr string) *JsPromise {
+func (ws *WsConn) openSocket(addr string, protocols []string) *JsPromise {
 	ws.cb = JsCallbackOf(func(v []JsValue) {
 		ev := jsevent{
 			event: EventType(v[0].Int()),
@@ -79,8 +127,21 @@ func (ws *WsConn) openSocket(addr string) *JsPromise {
 		"running": true,
 	})
 
-	setup := JsNativeFuncOf("addr", "event", "state", script)
-	return JsPromiseInstance(setup.Invoke(addr, ws.cb, ws.state))
+	offer := Undefined
+	if len(protocols) != 0 {
+		list := make([]interface{}, len(protocols))
+		for i, p := range protocols {
+			list[i] = p
+		}
+		offer = JsValueOf(list)
+	}
+	setup := JsNativeFuncOf("addr", "event", "state", "protocols", script)
+	return JsPromiseInstance(setup.Invoke(addr, ws.cb, ws.state, offer))
+}
+
+// Protocol returns the subprotocol the proxy selected, empty when none.
+func (ws *WsConn) Protocol() string {
+	return ws.ws.Get("protocol").String()
 }
 
 func (ws *WsConn) Close() error {
@@ -95,6 +156,25 @@ func (ws *WsConn) Close() error {
 	return ws.err
 }
 
+// CloseError returns the close code and reason once the proxy has closed
+// the connection, nil otherwise.
+func (ws *WsConn) CloseError() *CloseError {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	var ce *CloseError
+	errors.As(ws.err, &ce)
+	return ce
+}
+
+// ProxyError returns the error the proxy reported before closing the
+// connection, nil if it reported none. Reads return it once the close
+// arrived.
+func (ws *WsConn) ProxyError() *ProxyError {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.ctl
+}
+
 func (ws *WsConn) wakeRead() {
 	select {
 	case ws.read <- struct{}{}:
@@ -107,6 +187,8 @@ const (
 	eventOpened = EventType(1)
 	eventClosed = EventType(2)
 	eventData   = EventType(3)
+	// eventControl is a text message, data is sent in binary ones.
+	eventControl = EventType(4)
 )
 
 func (ws *WsConn) loop() {
@@ -118,8 +200,16 @@ func (ws *WsConn) loop() {
 		case ev := <-ws.events:
 			switch ev.event {
 			case eventClosed:
+				ce := &CloseError{
+					Code:   ev.Data.Get("code").Int(),
+					Reason: ev.Data.Get("reason").String(),
+				}
 				ws.mu.Lock()
-				ws.err = errors.New("ws: connection closed")
+				ws.err = ce
+				if ws.ctl != nil {
+					ws.ctl.Close = ce
+					ws.err = ws.ctl
+				}
 				ws.mu.Unlock()
 				ws.wakeRead()
 				return
@@ -129,6 +219,17 @@ func (ws *WsConn) loop() {
 				ws.mu.Unlock()
 				ws.wakeRead()
 				return
+			case eventControl:
+				data := []byte(ev.Data.String())
+				if notice := parseDraining(data); notice != nil {
+					ws.drainWatch.set(notice)
+				} else if pe := parseControl(data); pe != nil {
+					ws.mu.Lock()
+					if ws.ctl == nil {
+						ws.ctl = pe
+					}
+					ws.mu.Unlock()
+				}
 			case eventData:
 				arr := ev.Data
 				size := arr.Get("length").Int()
@@ -218,7 +319,16 @@ func (ws *WsConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
-func DialWithContext(ctx context.Context, addr string) (_ net.Conn, gerr error) {
+func DialWithContext(ctx context.Context, addr string) (net.Conn, error) {
+	ws, err := dial(ctx, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// dial opens a WebSocket to addr offering the given subprotocols.
+func dial(ctx context.Context, addr string, protocols []string) (_ *WsConn, gerr error) {
 	ws := &WsConn{
 		events: make(chan jsevent, 2),
 		done:   make(chan struct{}),
@@ -234,7 +344,7 @@ func DialWithContext(ctx context.Context, addr string) (_ net.Conn, gerr error)
 		}
 	}()
 
-	p := ws.openSocket(addr)
+	p := ws.openSocket(addr, protocols)
 	out, err := p.JsAwaitContext(ctx)
 	if err != nil {
 		defer func() {
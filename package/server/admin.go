@@ -0,0 +1,326 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// adminEventBuffer is how many events a slow SSE subscriber may lag
+	// behind before events are dropped for it.
+	adminEventBuffer = 64
+	sseKeepalive     = 15 * time.Second
+)
+
+// AdminConfig enables the admin API, which lists live tunnels and closes
+// them on request.
+type AdminConfig struct {
+	// Listen is an optional separate host:port for the API, otherwise it
+	// is served under /admin/ next to the tunnel endpoint. Changing it
+	// needs a restart.
+	Listen string `yaml:"listen"`
+	// Users authenticate with their bearer token.
+	Users []TicketUser `yaml:"users"`
+}
+
+// Enabled reports whether any admin user is configured.
+func (c *AdminConfig) Enabled() bool {
+	return len(c.Users) != 0
+}
+
+// Admin holds the users of the admin API.
+type Admin struct {
+	users bearerUsers
+}
+
+func NewAdmin(cfg AdminConfig) (*Admin, error) {
+	users, err := loadBearerUsers("admin.users", cfg.Users)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, errors.New("admin: no users")
+	}
+	return &Admin{users: users}, nil
+}
+
+// TunnelInfo is the admin API view of a tunnel.
+type TunnelInfo struct {
+	ID         string    `json:"id"`
+	ClientIP   string    `json:"client_ip"`
+	Origin     string    `json:"origin,omitempty"`
+	User       string    `json:"user,omitempty"`
+	ClientCert string    `json:"client_cert,omitempty"`
+	TargetName string    `json:"target_name,omitempty"`
+	TargetHost string    `json:"target_host"`
+	TargetPort int       `json:"target_port"`
+	ResolvedIP string    `json:"resolved_ip,omitempty"`
+	Upstream   string    `json:"upstream,omitempty"`
+	HostKey    string    `json:"host_key,omitempty"`
+	Start      time.Time `json:"start"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	// End and CloseReason are only set in close events.
+	End         *time.Time `json:"end,omitempty"`
+	CloseReason string     `json:"close_reason,omitempty"`
+}
+
+// TunnelEvent is sent on the admin event stream when a tunnel opens, that
+// is its target was dialed, when any tunnel closes and when a target
+// presents another host key than the known one.
+type TunnelEvent struct {
+	Type   string     `json:"type"`
+	Tunnel TunnelInfo `json:"tunnel"`
+	// KnownHostKey is the fingerprint of the known host key in
+	// host_key_changed events, Tunnel.HostKey the presented one.
+	KnownHostKey string `json:"known_host_key,omitempty"`
+}
+
+const (
+	eventOpen           = "open"
+	eventClose          = "close"
+	eventHostKeyChanged = "host_key_changed"
+)
+
+// tunnelEvents fans tunnel events out to the admin event streams.
+type tunnelEvents struct {
+	mu          sync.Mutex
+	subscribers map[chan TunnelEvent]struct{}
+	closed      bool
+}
+
+func newTunnelEvents() *tunnelEvents {
+	return &tunnelEvents{subscribers: make(map[chan TunnelEvent]struct{})}
+}
+
+// subscribe returns a channel of events, which is closed when the server
+// shuts down. It returns nil when already shut down.
+func (e *tunnelEvents) subscribe() chan TunnelEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil
+	}
+	ch := make(chan TunnelEvent, adminEventBuffer)
+	e.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (e *tunnelEvents) unsubscribe(ch chan TunnelEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.subscribers[ch]; ok {
+		delete(e.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (e *tunnelEvents) publish(typ string, t *tunnel) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.subscribers) == 0 {
+		return
+	}
+	ev := TunnelEvent{Type: typ, Tunnel: t.info()}
+	if typ == eventClose {
+		end := t.end
+		ev.Tunnel.End, ev.Tunnel.CloseReason = &end, t.closeReason
+	}
+	e.send(ev)
+}
+
+func (e *tunnelEvents) publishHostKeyChange(t *tunnel, known string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.subscribers) == 0 {
+		return
+	}
+	e.send(TunnelEvent{Type: eventHostKeyChanged, Tunnel: t.info(), KnownHostKey: known})
+}
+
+// send hands ev to every subscriber with room for it. e.mu must be held.
+func (e *tunnelEvents) send(ev TunnelEvent) {
+	for ch := range e.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// close ends every event stream.
+func (e *tunnelEvents) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	for ch := range e.subscribers {
+		delete(e.subscribers, ch)
+		close(ch)
+	}
+}
+
+type adminUserKey struct{}
+
+// adminHandler returns the admin API, every request must carry an admin's
+// bearer token:
+//
+//	GET    /admin/tunnels       list live tunnels
+//	GET    /admin/tunnels/{id}  show one tunnel
+//	DELETE /admin/tunnels/{id}  close a tunnel
+//	GET    /admin/events        server-sent events of opened and closed tunnels
+//	                            and changed host keys
+//	GET    /admin/host-keys     list known host keys by host:port
+//	DELETE /admin/host-keys/{target}
+//	                            forget a host key, the next one is recorded
+func (s *WsToTcpServer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/host-keys", s.adminListHostKeys)
+	mux.HandleFunc("DELETE /admin/host-keys/{target}", s.adminForgetHostKey)
+	mux.HandleFunc("GET /admin/tunnels", s.adminListTunnels)
+	mux.HandleFunc("GET /admin/tunnels/{id}", s.adminGetTunnel)
+	mux.HandleFunc("DELETE /admin/tunnels/{id}", s.adminCloseTunnel)
+	mux.HandleFunc("GET /admin/events", s.adminEvents)
+	return s.adminOnly(mux)
+}
+
+// adminOnly serves handler to requests carrying an admin's bearer token,
+// and nothing when the admin API is disabled.
+func (s *WsToTcpServer) adminOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := s.current()
+		if settings.Admin == nil {
+			http.NotFound(w, r)
+			return
+		}
+		admin, ok := settings.Admin.users.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gowasmssh admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminUserKey{}, admin)))
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *WsToTcpServer) adminListTunnels(w http.ResponseWriter, r *http.Request) {
+	open := s.tunnels.list()
+	infos := make([]TunnelInfo, 0, len(open))
+	for _, t := range open {
+		infos = append(infos, t.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Start.Before(infos[j].Start)
+	})
+	writeJSON(w, infos)
+}
+
+func (s *WsToTcpServer) adminGetTunnel(w http.ResponseWriter, r *http.Request) {
+	t := s.tunnels.get(r.PathValue("id"))
+	if t == nil {
+		http.Error(w, "no such tunnel", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, t.info())
+}
+
+func (s *WsToTcpServer) adminCloseTunnel(w http.ResponseWriter, r *http.Request) {
+	t := s.tunnels.get(r.PathValue("id"))
+	if t == nil {
+		http.Error(w, "no such tunnel", http.StatusNotFound)
+		return
+	}
+	admin, _ := r.Context().Value(adminUserKey{}).(string)
+	s.logger().Info("closing tunnel on admin request", "id", t.id, "admin", admin)
+	t.closeWith(CloseTerminated, "closed by an administrator")
+	t.cancel()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *WsToTcpServer) adminEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events := s.events.subscribe()
+	if events == nil {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ticker := time.NewTicker(sseKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *WsToTcpServer) adminListHostKeys(w http.ResponseWriter, r *http.Request) {
+	hk := s.current().HostKeys
+	if hk == nil {
+		http.Error(w, "host keys are not tracked", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, hk.store.list())
+}
+
+func (s *WsToTcpServer) adminForgetHostKey(w http.ResponseWriter, r *http.Request) {
+	hk := s.current().HostKeys
+	if hk == nil {
+		http.Error(w, "host keys are not tracked", http.StatusNotFound)
+		return
+	}
+	target := r.PathValue("target")
+	ok, err := hk.store.forget(target)
+	if err != nil {
+		s.logger().Error("can't save host keys", "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "no such host key", http.StatusNotFound)
+		return
+	}
+	admin, _ := r.Context().Value(adminUserKey{}).(string)
+	s.logger().Info("forgot host key on admin request", "target", target, "admin", admin)
+	w.WriteHeader(http.StatusNoContent)
+}
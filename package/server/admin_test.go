@@ -0,0 +1,169 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// adminRequest sends a request with token to the admin API at url.
+func adminRequest(t *testing.T, method, url, token string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAdminAuth(t *testing.T) {
+	s, _ := newTestServer(t, &Config{})
+	ts := httptest.NewServer(s.adminHandler())
+	defer ts.Close()
+	if resp := adminRequest(t, "GET", ts.URL+"/admin/tunnels", "secret"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("admin API disabled: status %d", resp.StatusCode)
+	}
+
+	s, _ = newTestServer(t, &Config{Admin: AdminConfig{Users: []TicketUser{{ID: "ops", Token: "secret"}}}})
+	ts = httptest.NewServer(s.adminHandler())
+	defer ts.Close()
+	for _, token := range []string{"", "wrong"} {
+		resp := adminRequest(t, "GET", ts.URL+"/admin/tunnels", token)
+		if resp.StatusCode != http.StatusUnauthorized || len(resp.Header.Get("WWW-Authenticate")) == 0 {
+			t.Errorf("token %q: status %d, WWW-Authenticate %q", token, resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+	if resp := adminRequest(t, "GET", ts.URL+"/admin/tunnels", "secret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("admin token: status %d", resp.StatusCode)
+	}
+}
+
+func TestAdminTunnels(t *testing.T) {
+	port := muxTestTarget(t, func(c net.Conn) { io.Copy(c, c) })
+	s, url := newTestServer(t, &Config{Admin: AdminConfig{Users: []TicketUser{{ID: "ops", Token: "secret"}}}})
+	ts := httptest.NewServer(s.adminHandler())
+	defer ts.Close()
+
+	events := adminRequest(t, "GET", ts.URL+"/admin/events", "secret")
+	if ct := events.Header.Get("Content-Type"); events.StatusCode != http.StatusOK || ct != "text/event-stream" {
+		t.Fatalf("events: status %d, content type %q", events.StatusCode, ct)
+	}
+	lines := bufio.NewScanner(events.Body)
+	nextEvent := func() TunnelEvent {
+		t.Helper()
+		for lines.Scan() {
+			if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+				var ev TunnelEvent
+				if err := json.Unmarshal([]byte(data), &ev); err != nil {
+					t.Fatal(err)
+				}
+				return ev
+			}
+		}
+		t.Fatalf("event stream ended: %v", lines.Err())
+		return TunnelEvent{}
+	}
+
+	conn := dialTunnel(t, url, port)
+	if ev := nextEvent(); ev.Type != eventOpen || ev.Tunnel.TargetPort != port {
+		t.Errorf("open event %+v", ev)
+	}
+
+	var list []TunnelInfo
+	if err := json.NewDecoder(adminRequest(t, "GET", ts.URL+"/admin/tunnels", "secret").Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].TargetHost != "127.0.0.1" || list[0].TargetPort != port {
+		t.Fatalf("tunnels %+v", list)
+	}
+	id := list[0].ID
+	var info TunnelInfo
+	if err := json.NewDecoder(adminRequest(t, "GET", ts.URL+"/admin/tunnels/"+id, "secret").Body).Decode(&info); err != nil || info.ID != id {
+		t.Errorf("tunnel %s: %+v, %v", id, info, err)
+	}
+	for _, method := range []string{"GET", "DELETE"} {
+		if resp := adminRequest(t, method, ts.URL+"/admin/tunnels/unknown", "secret"); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s of an unknown tunnel: status %d", method, resp.StatusCode)
+		}
+	}
+
+	if resp := adminRequest(t, "DELETE", ts.URL+"/admin/tunnels/"+id, "secret"); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("close: status %d", resp.StatusCode)
+	}
+	if m := readControl(t, conn); m.Code != ErrCodeTerminated {
+		t.Errorf("close message %+v", m)
+	}
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseTerminated {
+		t.Errorf("read after the close message: %v, want close %d", err, CloseTerminated)
+	}
+	if ev := nextEvent(); ev.Type != eventClose || ev.Tunnel.ID != id || ev.Tunnel.End == nil || len(ev.Tunnel.CloseReason) == 0 {
+		t.Errorf("close event %+v", ev)
+	}
+
+	// Shutting down ends the event stream.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Shutdown()
+	}()
+	for lines.Scan() {
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown still waiting")
+	}
+}
+
+func TestAdminHostKeys(t *testing.T) {
+	users := AdminConfig{Users: []TicketUser{{ID: "ops", Token: "secret"}}}
+	s, _ := newTestServer(t, &Config{Admin: users})
+	ts := httptest.NewServer(s.adminHandler())
+	defer ts.Close()
+	if resp := adminRequest(t, "GET", ts.URL+"/admin/host-keys", "secret"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("host keys not tracked: status %d", resp.StatusCode)
+	}
+
+	store := filepath.Join(t.TempDir(), "known_hosts.json")
+	s, _ = newTestServer(t, &Config{Admin: users, HostKeys: HostKeyConfig{Store: store}})
+	ts = httptest.NewServer(s.adminHandler())
+	defer ts.Close()
+	if _, _, err := s.current().HostKeys.store.check("192.0.2.1:22", testHostKey(t).PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	var keys map[string]KnownHostKey
+	if err := json.NewDecoder(adminRequest(t, "GET", ts.URL+"/admin/host-keys", "secret").Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := keys["192.0.2.1:22"]; len(keys) != 1 || !ok || !strings.HasPrefix(k.Fingerprint, "SHA256:") {
+		t.Errorf("host keys %+v", keys)
+	}
+	for _, status := range []int{http.StatusNoContent, http.StatusNotFound} {
+		if resp := adminRequest(t, "DELETE", ts.URL+"/admin/host-keys/192.0.2.1:22", "secret"); resp.StatusCode != status {
+			t.Errorf("forget: status %d, want %d", resp.StatusCode, status)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// minBandwidthBurst keeps a full read buffer within one token bucket wait.
+const minBandwidthBurst = 4096
+
+// BandwidthLimit is a token bucket in bytes per second. A zero Rate
+// disables the limit, Burst defaults to one second worth of traffic.
+type BandwidthLimit struct {
+	Rate  int `yaml:"rate"`
+	Burst int `yaml:"burst"`
+}
+
+// BandwidthConfig shapes tunnel traffic. Every limit applies to each
+// direction separately.
+type BandwidthConfig struct {
+	// PerTunnel limits every tunnel on its own.
+	PerTunnel BandwidthLimit `yaml:"per_tunnel"`
+	// PerClient limits all tunnels of one client IP together.
+	PerClient BandwidthLimit `yaml:"per_client"`
+	// Global limits all tunnels together.
+	Global BandwidthLimit `yaml:"global"`
+}
+
+func (l BandwidthLimit) validate(name string) error {
+	if l.Rate < 0 || l.Burst < 0 {
+		return fmt.Errorf("bandwidth.%s: rate and burst must not be negative", name)
+	}
+	if l.Burst != 0 && l.Burst < minBandwidthBurst {
+		return fmt.Errorf("bandwidth.%s: burst must be at least %d bytes", name, minBandwidthBurst)
+	}
+	return nil
+}
+
+func (l BandwidthLimit) burst() int {
+	if l.Burst == 0 {
+		return max(l.Rate, minBandwidthBurst)
+	}
+	return l.Burst
+}
+
+func (l BandwidthLimit) newLimiter() *rate.Limiter {
+	if l.Rate == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(l.Rate), l.burst())
+}
+
+// apply sets the rate and burst of l on every limiter of d.
+func (l BandwidthLimit) apply(d directions) {
+	for _, lim := range d {
+		if lim != nil {
+			lim.SetLimit(rate.Limit(l.Rate))
+			lim.SetBurst(l.burst())
+		}
+	}
+}
+
+// directions holds one limiter per direction, indexed by dirIndex.
+type directions [2]*rate.Limiter
+
+func dirIndex(dir string) int {
+	if dir == dirIn {
+		return 0
+	}
+	return 1
+}
+
+func (l BandwidthLimit) newDirections() directions {
+	return directions{l.newLimiter(), l.newLimiter()}
+}
+
+// Shaper hands out the bandwidth limiters of new tunnels.
+type Shaper struct {
+	cfg    BandwidthConfig
+	global directions
+	// clients is shared with the Shapers of later settings, see adopt.
+	clients *clientShapes
+}
+
+// clientShapes are the per client limiters of the clients with open
+// tunnels.
+type clientShapes struct {
+	mu     sync.Mutex
+	shapes map[string]*clientShape
+}
+
+type clientShape struct {
+	limits directions
+	refs   int
+}
+
+func NewShaper(cfg BandwidthConfig) (*Shaper, error) {
+	if err := cfg.PerTunnel.validate("per_tunnel"); err != nil {
+		return nil, err
+	}
+	if err := cfg.PerClient.validate("per_client"); err != nil {
+		return nil, err
+	}
+	if err := cfg.Global.validate("global"); err != nil {
+		return nil, err
+	}
+	return &Shaper{
+		cfg:     cfg,
+		global:  cfg.Global.newDirections(),
+		clients: &clientShapes{shapes: make(map[string]*clientShape)},
+	}, nil
+}
+
+// adopt takes over the global and per client limiters of prev, adjusted to
+// the rates of s, so tunnels opened before and after a reload share them
+// and the configured rates hold across it. Tunnels keep their own
+// per tunnel limiters.
+func (s *Shaper) adopt(prev *Shaper) {
+	if s == nil || prev == nil || prev == s {
+		return
+	}
+	if s.cfg.Global.Rate > 0 && prev.cfg.Global.Rate > 0 {
+		s.cfg.Global.apply(prev.global)
+		s.global = prev.global
+	}
+	s.clients = prev.clients
+	s.clients.mu.Lock()
+	defer s.clients.mu.Unlock()
+	if s.cfg.PerClient.Rate > 0 {
+		for _, c := range s.clients.shapes {
+			s.cfg.PerClient.apply(c.limits)
+		}
+	}
+}
+
+// acquire returns the limiters a new tunnel of ip must honor for dirIn and
+// dirOut. release must be called when the tunnel is closed. A nil Shaper
+// limits nothing.
+func (s *Shaper) acquire(ip string) (in, out []*rate.Limiter, release func()) {
+	if s == nil {
+		return nil, nil, func() {}
+	}
+	tunnel := s.cfg.PerTunnel.newDirections()
+	clients := s.clients
+	var client directions
+	shaped := s.cfg.PerClient.Rate > 0
+	if shaped {
+		clients.mu.Lock()
+		c := clients.shapes[ip]
+		if c == nil {
+			c = &clientShape{limits: s.cfg.PerClient.newDirections()}
+			clients.shapes[ip] = c
+		}
+		c.refs++
+		client = c.limits
+		clients.mu.Unlock()
+	}
+	pick := func(dir string) []*rate.Limiter {
+		var list []*rate.Limiter
+		for _, l := range []*rate.Limiter{tunnel[dirIndex(dir)], client[dirIndex(dir)], s.global[dirIndex(dir)]} {
+			if l != nil {
+				list = append(list, l)
+			}
+		}
+		return list
+	}
+	var once sync.Once
+	return pick(dirIn), pick(dirOut), func() {
+		once.Do(func() {
+			if !shaped {
+				return
+			}
+			clients.mu.Lock()
+			if c := clients.shapes[ip]; c != nil {
+				if c.refs--; c.refs == 0 {
+					delete(clients.shapes, ip)
+				}
+			}
+			clients.mu.Unlock()
+		})
+	}
+}
+
+// waitBandwidth blocks until n bytes may pass every limiter.
+func waitBandwidth(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, l := range limiters {
+		for left := n; left > 0; {
+			chunk := min(left, l.Burst())
+			if err := l.WaitN(ctx, chunk); err != nil {
+				return err
+			}
+			left -= chunk
+		}
+	}
+	return nil
+}
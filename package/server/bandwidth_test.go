@@ -0,0 +1,76 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestTunnelBandwidth(t *testing.T) {
+	const (
+		limit = 16 * 1024
+		size  = 2 * limit
+	)
+	port := muxTestTarget(t, func(c net.Conn) {
+		c.Write(make([]byte, size))
+		io.Copy(io.Discard, c)
+	})
+	_, url := newTestServer(t, &Config{Bandwidth: BandwidthConfig{PerTunnel: BandwidthLimit{Rate: limit}}})
+	conn := dialMux(t, url)
+	start := time.Now()
+	openMuxStream(t, conn, 1, port)
+	readMuxData(t, conn, 1, size)
+	// One second worth of burst, then the rate.
+	if elapsed, want := time.Since(start), time.Duration(size-limit)*time.Second/limit; elapsed < want*9/10 {
+		t.Errorf("%d bytes arrived after %v, want at least %v", size, elapsed, want)
+	}
+}
+
+func TestShaperAdopt(t *testing.T) {
+	limit := func(r int) BandwidthLimit { return BandwidthLimit{Rate: r} }
+	prev, err := NewShaper(BandwidthConfig{PerClient: limit(8192), Global: limit(65536)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, _, release := prev.acquire("192.0.2.1")
+	defer release()
+
+	next, err := NewShaper(BandwidthConfig{PerTunnel: limit(4096), PerClient: limit(16384), Global: limit(131072)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.adopt(prev)
+	nextIn, _, nextRelease := next.acquire("192.0.2.1")
+	defer nextRelease()
+	if len(in) != 2 || len(nextIn) != 3 {
+		t.Fatalf("%d limiters before the reload, %d after", len(in), len(nextIn))
+	}
+	// Tunnels of the client share its limiter and the global one across
+	// the reload, at the new rates, and new tunnels get the new per
+	// tunnel limit.
+	for i, want := range []rate.Limit{16384, 131072} {
+		if in[i] != nextIn[i+1] || in[i].Limit() != want {
+			t.Errorf("limiter %d: shared %v, rate %v, want %v", i, in[i] == nextIn[i+1], in[i].Limit(), want)
+		}
+	}
+	if nextIn[0].Limit() != 4096 {
+		t.Errorf("per tunnel rate %v", nextIn[0].Limit())
+	}
+
+	unshaped, err := NewShaper(BandwidthConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unshaped.adopt(next)
+	if in, out, release := unshaped.acquire("192.0.2.1"); len(in)+len(out) != 0 {
+		t.Errorf("%d limiters once shaping is off", len(in)+len(out))
+	} else {
+		release()
+	}
+}
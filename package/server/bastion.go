@@ -0,0 +1,281 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	bastionKeepalive        = 30 * time.Second
+	bastionKeepaliveTimeout = 15 * time.Second
+)
+
+// bastion opens target connections as direct-tcpip channels of one SSH
+// connection to a jump host, which is established on first use and again
+// after it broke.
+type bastion struct {
+	name    string
+	addr    string
+	config  *ssh.ClientConfig
+	forward *net.Dialer
+	// logger is the server's, set by Apply before the bastion is used.
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	client *ssh.Client
+	// connecting is the dial to the jump host in progress, nil when there
+	// is none. Only one runs at a time and b.mu is not held during it.
+	connecting *bastionDial
+	// active counts open channels, a retired bastion disconnects once
+	// none are left.
+	active  int
+	retired bool
+}
+
+func newBastion(name string, proxyURL *url.URL, password string, cfg UpstreamConfig, forward *net.Dialer) (*bastion, error) {
+	user := proxyURL.User.Username()
+	if len(user) == 0 {
+		return nil, errors.New("url: ssh upstream needs a user")
+	}
+	var auth []ssh.AuthMethod
+	if len(cfg.KeyFile) != 0 {
+		pem, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("key_file: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("key_file: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if len(password) != 0 {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("ssh upstream needs key_file or a password")
+	}
+	hostKeyCallback, err := bastionHostKeyCallback(cfg)
+	if err != nil {
+		return nil, err
+	}
+	addr := proxyURL.Host
+	if len(proxyURL.Port()) == 0 {
+		addr = net.JoinHostPort(proxyURL.Hostname(), "22")
+	}
+	return &bastion{
+		name: name,
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         dialTimeout,
+		},
+		forward: forward,
+	}, nil
+}
+
+// bastionHostKeyCallback pins the jump host key to HostKey, either an
+// authorized_keys line or a SHA256 fingerprint, or to a known_hosts file.
+func bastionHostKeyCallback(cfg UpstreamConfig) (ssh.HostKeyCallback, error) {
+	switch {
+	case len(cfg.HostKey) != 0 && len(cfg.KnownHostsFile) != 0:
+		return nil, errors.New("set only one of host_key and known_hosts")
+	case len(cfg.KnownHostsFile) != 0:
+		callback, err := knownhosts.New(cfg.KnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("known_hosts: %w", err)
+		}
+		return callback, nil
+	case strings.HasPrefix(cfg.HostKey, "SHA256:"):
+		fingerprint := []byte(cfg.HostKey)
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if subtle.ConstantTimeCompare([]byte(ssh.FingerprintSHA256(key)), fingerprint) != 1 {
+				return fmt.Errorf("host key %s of %s does not match host_key", ssh.FingerprintSHA256(key), hostname)
+			}
+			return nil
+		}, nil
+	case len(cfg.HostKey) != 0:
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cfg.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("host_key: %w", err)
+		}
+		return ssh.FixedHostKey(key), nil
+	}
+	return nil, errors.New("ssh upstream needs host_key or known_hosts")
+}
+
+func (b *bastion) dial(ctx context.Context, addr string) (net.Conn, error) {
+	client, err := b.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		b.release()
+		return nil, err
+	}
+	return &bastionConn{Conn: conn, b: b}, nil
+}
+
+func (b *bastion) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active--
+	b.closeIfRetired()
+}
+
+// retire disconnects from the jump host once the open channels are
+// closed, it is called when a reload replaced the bastion.
+func (b *bastion) retire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.retired = true
+	b.closeIfRetired()
+}
+
+func (b *bastion) closeIfRetired() {
+	if b.retired && b.active == 0 && b.client != nil {
+		b.client.Close()
+		b.client = nil
+	}
+}
+
+// bastionConn is a channel to a target, closing it releases the bastion.
+type bastionConn struct {
+	net.Conn
+	b    *bastion
+	once sync.Once
+}
+
+func (c *bastionConn) Close() error {
+	c.once.Do(c.b.release)
+	return c.Conn.Close()
+}
+
+// bastionDial is a dial to the jump host, done is closed once err is set.
+type bastionDial struct {
+	done chan struct{}
+	err  error
+}
+
+// connect returns the SSH connection to the jump host, dialing it when
+// there is none, and counts a channel the caller must release. Callers
+// arriving during a dial wait for it and share its outcome, unless it
+// failed because the dialing caller's context ended.
+func (b *bastion) connect(ctx context.Context) (*ssh.Client, error) {
+	for {
+		b.mu.Lock()
+		if client := b.client; client != nil {
+			b.active++
+			b.mu.Unlock()
+			return client, nil
+		}
+		if d := b.connecting; d != nil {
+			b.mu.Unlock()
+			select {
+			case <-d.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if d.err != nil && !errors.Is(d.err, context.Canceled) && !errors.Is(d.err, context.DeadlineExceeded) {
+				return nil, d.err
+			}
+			continue
+		}
+		d := &bastionDial{done: make(chan struct{})}
+		b.connecting = d
+		b.mu.Unlock()
+
+		client, err := b.handshake(ctx)
+		b.mu.Lock()
+		b.connecting = nil
+		d.err = err
+		close(d.done)
+		if err != nil {
+			b.mu.Unlock()
+			return nil, err
+		}
+		b.client = client
+		b.active++
+		b.mu.Unlock()
+		go b.keepalive(client)
+		go func() {
+			err := client.Wait()
+			b.mu.Lock()
+			if b.client == client {
+				b.client = nil
+			}
+			b.mu.Unlock()
+			b.log().Warn("bastion connection closed", "upstream", b.name, "addr", b.addr, "error", err)
+		}()
+		return client, nil
+	}
+}
+
+// handshake dials the jump host and logs in.
+func (b *bastion) handshake(ctx context.Context) (*ssh.Client, error) {
+	conn, err := b.forward.DialContext(ctx, "tcp", b.addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, b.addr, b.config)
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ssh %s: %w", b.addr, err)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func (b *bastion) log() *slog.Logger {
+	if b.logger != nil {
+		return b.logger
+	}
+	return slog.Default()
+}
+
+// keepalive closes client once the jump host stops answering, so the next
+// dial reconnects instead of waiting on a dead connection.
+func (b *bastion) keepalive(client *ssh.Client) {
+	ticker := time.NewTicker(bastionKeepalive)
+	defer ticker.Stop()
+	for range ticker.C {
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err == nil {
+				continue
+			}
+		case <-time.After(bastionKeepaliveTimeout):
+		}
+		client.Close()
+		return
+	}
+}
@@ -0,0 +1,117 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the on-disk configuration of the proxy server.
+type Config struct {
+	// Listen is the host:port of the tunnel endpoint, 0.0.0.0:9090 when
+	// empty. Changing it, TLS files aside, needs a restart.
+	Listen string `yaml:"listen"`
+	// Listeners, when set, replace Listen, see ListenerConfig.
+	Listeners []ListenerConfig `yaml:"listeners"`
+	// BasePath is the URL prefix to serve under, StaticDir an optional
+	// directory to serve the web page from. Both need a restart.
+	BasePath  string `yaml:"base_path"`
+	StaticDir string `yaml:"static_dir"`
+	// TrustedProxies are the load balancers in front of the server, CIDRs,
+	// addresses or "unix" for peers on Unix socket listeners. Their PROXY
+	// protocol headers and X-Forwarded-For headers name the client.
+	TrustedProxies []string         `yaml:"trusted_proxies"`
+	TLS            TLSConfig        `yaml:"tls"`
+	Origins        OriginConfig     `yaml:"origins"`
+	Policy         PolicyConfig     `yaml:"policy"`
+	Upstreams      []UpstreamConfig `yaml:"upstreams"`
+	Targets        TargetsConfig    `yaml:"targets"`
+	HostKeys       HostKeyConfig    `yaml:"host_keys"`
+	Tickets        TicketConfig     `yaml:"tickets"`
+	Limits         LimitConfig      `yaml:"limits"`
+	Bandwidth      BandwidthConfig  `yaml:"bandwidth"`
+	WebSocket      WebSocketConfig  `yaml:"websocket"`
+	Timeouts       TimeoutConfig    `yaml:"timeouts"`
+	Metrics        MetricsConfig    `yaml:"metrics"`
+	Admin          AdminConfig      `yaml:"admin"`
+	Health         HealthConfig     `yaml:"health"`
+	Log            LogConfig        `yaml:"log"`
+}
+
+// TimeoutConfig bounds how long tunnels stay open, zero disables a bound.
+type TimeoutConfig struct {
+	// Idle closes tunnels without traffic in either direction.
+	Idle time.Duration `yaml:"idle"`
+	// MaxLifetime closes tunnels regardless of traffic.
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
+	// Drain is how long shutdown waits for tunnels to end on their own,
+	// 30s when zero. Tunnels are told when it starts.
+	Drain time.Duration `yaml:"drain"`
+	// SSHBanner is how long both sides of a tunnel that must speak SSH
+	// have to send their identification line, 10s when zero.
+	SSHBanner time.Duration `yaml:"ssh_banner"`
+}
+
+func (c *TimeoutConfig) validate() error {
+	switch {
+	case c.Idle < 0:
+		return fmt.Errorf("timeouts.idle: must not be negative")
+	case c.MaxLifetime < 0:
+		return fmt.Errorf("timeouts.max_lifetime: must not be negative")
+	case c.Drain < 0:
+		return fmt.Errorf("timeouts.drain: must not be negative")
+	case c.SSHBanner < 0:
+		return fmt.Errorf("timeouts.ssh_banner: must not be negative")
+	}
+	return nil
+}
+
+// MetricsConfig controls the Prometheus endpoint.
+type MetricsConfig struct {
+	// Listen is an optional separate host:port for /metrics. Without it
+	// /metrics is served on the tunnel endpoint to admin users only.
+	Listen string `yaml:"listen"`
+}
+
+// OriginConfig lists the browser origins that may open tunnels, see
+// OriginPolicy for the accepted patterns.
+type OriginConfig struct {
+	Allow []string `yaml:"allow"`
+	// AllowAny disables the Origin check, for development only.
+	AllowAny bool `yaml:"allow_any"`
+}
+
+// LoadConfig reads a YAML config file.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &Config{}
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	// An empty file, or one with only comments, is an empty config.
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// OriginPolicy builds the origin policy described by c, falling back to
+// DefaultOrigins when no origin is listed.
+func (c *OriginConfig) OriginPolicy() (*OriginPolicy, error) {
+	allow := c.Allow
+	if len(allow) == 0 {
+		allow = DefaultOrigins
+	}
+	return NewOriginPolicy(allow, c.AllowAny)
+}
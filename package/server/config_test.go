@@ -0,0 +1,24 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import "testing"
+
+func TestLoadConfig(t *testing.T) {
+	for _, data := range []string{"", "# nothing configured yet\n"} {
+		cfg, err := LoadConfig(writeTestFile(t, "config.yaml", []byte(data)))
+		if err != nil || cfg == nil {
+			t.Errorf("LoadConfig(%q) = %v, %v, want an empty config", data, cfg, err)
+		}
+	}
+	cfg, err := LoadConfig(writeTestFile(t, "config.yaml", []byte("listen: 127.0.0.1:8080\n")))
+	if err != nil || cfg.Listen != "127.0.0.1:8080" {
+		t.Errorf("LoadConfig = %+v, %v", cfg, err)
+	}
+	for _, data := range []string{"listen: [\n", "lsiten: 127.0.0.1:8080\n"} {
+		if _, err := LoadConfig(writeTestFile(t, "config.yaml", []byte(data))); err == nil {
+			t.Errorf("LoadConfig(%q) succeeded, want an error", data)
+		}
+	}
+}
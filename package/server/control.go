@@ -0,0 +1,106 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Error codes of control messages. The wasm client turns them into typed
+// errors, keep js/errors.go in sync.
+const (
+	ErrCodeBadRequest     = "bad_request"
+	ErrCodeUnauthorized   = "unauthorized"
+	ErrCodePolicyDenied   = "policy_denied"
+	ErrCodeRateLimited    = "rate_limited"
+	ErrCodeTooManyTunnels = "too_many_tunnels"
+	ErrCodeShuttingDown   = "shutting_down"
+	ErrCodeUnknownTarget  = "unknown_target"
+	ErrCodeDialBlocked    = "dial_blocked"
+	ErrCodeDialTimeout    = "dial_timeout"
+	ErrCodeDialRefused    = "dial_refused"
+	ErrCodeDialDNS        = "dial_dns"
+	ErrCodeDialUpstream   = "dial_upstream"
+	ErrCodeDialFailed     = "dial_failed"
+	ErrCodeIdleTimeout    = "idle_timeout"
+	ErrCodeMaxLifetime    = "max_lifetime"
+	ErrCodeTerminated     = "terminated"
+	ErrCodeTunnelError    = "tunnel_error"
+	ErrCodeHostKeyChanged = "host_key_changed"
+	ErrCodeNotSSH         = "not_ssh"
+)
+
+// ControlMessage tells the browser why the server is about to close a
+// tunnel, it precedes every close but a normal one. Plain tunnels send it
+// as a JSON text frame, data always travels in binary frames, multiplexed
+// streams in a mux error frame.
+type ControlMessage struct {
+	// Type is "error", or "draining" for the notice open tunnels get when
+	// the server starts shutting down, which does not close them.
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RetryAfter is how many seconds to wait before trying again, when
+	// known.
+	RetryAfter int `json:"retry_after,omitempty"`
+	// CloseIn is how many seconds a draining server keeps the tunnel
+	// open at most.
+	CloseIn int `json:"close_in,omitempty"`
+}
+
+func errorMessage(code, message string, retryAfter time.Duration) ControlMessage {
+	msg := ControlMessage{Type: "error", Code: code, Message: message}
+	if retryAfter > 0 {
+		msg.RetryAfter = int((retryAfter + time.Second - 1) / time.Second)
+	}
+	return msg
+}
+
+// drainingMessage tells the browser the tunnel will be closed within
+// closeIn, so it can reconnect to another server in time.
+func drainingMessage(closeIn time.Duration) ControlMessage {
+	return ControlMessage{
+		Type:    "draining",
+		Code:    ErrCodeShuttingDown,
+		Message: "the proxy is shutting down, reconnect to continue",
+		CloseIn: int((closeIn + time.Second - 1) / time.Second),
+	}
+}
+
+// dialErrors maps dial failure reasons to error codes and what the browser
+// is told, the dial error itself may name internal addresses.
+var dialErrors = map[string]ControlMessage{
+	failDialBlocked:  errorMessage(ErrCodeDialBlocked, "the target address is not allowed", 0),
+	failDialTimeout:  errorMessage(ErrCodeDialTimeout, "the target did not answer in time", 0),
+	failDialRefused:  errorMessage(ErrCodeDialRefused, "the target refused the connection", 0),
+	failDialDNS:      errorMessage(ErrCodeDialDNS, "the target host name could not be resolved", 0),
+	failDialUpstream: errorMessage(ErrCodeDialUpstream, "the upstream proxy could not reach the target", 0),
+	failDialError:    errorMessage(ErrCodeDialFailed, "the target could not be reached", 0),
+}
+
+// closeErrorCodes maps the close codes of server ended tunnels to error
+// codes.
+var closeErrorCodes = map[int]string{
+	CloseGoingAway:                   ErrCodeShuttingDown,
+	CloseIdleTimeout:                 ErrCodeIdleTimeout,
+	CloseMaxLifetime:                 ErrCodeMaxLifetime,
+	CloseTerminated:                  ErrCodeTerminated,
+	CloseHostKeyChanged:              ErrCodeHostKeyChanged,
+	CloseNotSSH:                      ErrCodeNotSSH,
+	websocket.CloseInternalServerErr: ErrCodeTunnelError,
+}
+
+// refusedCloseCode is the close code of a tunnel refused with an HTTP
+// status after the upgrade.
+func refusedCloseCode(status int) int {
+	return 4000 + status
+}
+
+func (m ControlMessage) marshal() []byte {
+	data, _ := json.Marshal(m)
+	return data
+}
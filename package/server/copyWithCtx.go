@@ -8,6 +8,8 @@ import (
 	"io"
 	"net"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 type IReaderWithTimeout interface {
@@ -15,7 +17,7 @@ type IReaderWithTimeout interface {
 	SetReadDeadline(t time.Time) error
 }
 
-func copyData(ctx context.Context, src IReaderWithTimeout, dst io.Writer, counter chan<- int, stop <-chan struct{}) error {
+func copyData(ctx context.Context, src IReaderWithTimeout, dst io.Writer, counter chan<- int, stop <-chan struct{}, limiters []*rate.Limiter) error {
 	buf := make([]byte, 4096)
 	var remaining []byte
 
@@ -58,6 +60,11 @@ func copyData(ctx context.Context, src IReaderWithTimeout, dst io.Writer, counte
 			return nil
 		}
 
+		// 按带宽限制等待令牌
+		if err := waitBandwidth(ctx, limiters, n); err != nil {
+			return err
+		}
+
 		// 尝试写入所有读取的数据
 		nw, err := dst.Write(buf[:n])
 		if err != nil && err != io.ErrShortWrite {
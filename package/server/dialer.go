@@ -0,0 +1,156 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+const dialTimeout = 30 * time.Second
+
+// blockedRanges are the networks a public proxy must never be pointed at:
+// loopback, private, link-local, CGNAT, multicast and other special-purpose
+// ranges. IPv4-mapped IPv6 addresses are unmapped before the check, and the
+// IPv4 address NAT64 and 6to4 addresses embed is checked too, see
+// embeddedIPv4.
+var blockedRanges = []struct {
+	prefix netip.Prefix
+	name   string
+}{
+	{netip.MustParsePrefix("0.0.0.0/8"), "this network"},
+	{netip.MustParsePrefix("10.0.0.0/8"), "private"},
+	{netip.MustParsePrefix("100.64.0.0/10"), "carrier-grade NAT"},
+	{netip.MustParsePrefix("127.0.0.0/8"), "loopback"},
+	{netip.MustParsePrefix("169.254.0.0/16"), "link-local"},
+	{netip.MustParsePrefix("172.16.0.0/12"), "private"},
+	{netip.MustParsePrefix("192.0.0.0/24"), "IETF protocol assignments"},
+	{netip.MustParsePrefix("192.168.0.0/16"), "private"},
+	{netip.MustParsePrefix("198.18.0.0/15"), "benchmarking"},
+	{netip.MustParsePrefix("224.0.0.0/4"), "multicast"},
+	{netip.MustParsePrefix("240.0.0.0/4"), "reserved"},
+	{netip.MustParsePrefix("::/128"), "unspecified"},
+	{netip.MustParsePrefix("::1/128"), "loopback"},
+	// Local-use NAT64 prefixes may embed IPv4 at any RFC 6052 offset.
+	{netip.MustParsePrefix("64:ff9b:1::/48"), "local-use NAT64"},
+	{netip.MustParsePrefix("fc00::/7"), "unique-local"},
+	{netip.MustParsePrefix("fe80::/10"), "link-local"},
+	{netip.MustParsePrefix("ff00::/8"), "multicast"},
+}
+
+// BlockedAddrError is returned when the address a hostname resolved to is
+// not allowed to be dialed.
+type BlockedAddrError struct {
+	Addr   netip.AddrPort
+	Reason string
+}
+
+func (e *BlockedAddrError) Error() string {
+	return fmt.Sprintf("dial to %s blocked: %s", e.Addr, e.Reason)
+}
+
+var (
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour   = netip.MustParsePrefix("2002::/16")
+)
+
+func blockedRange(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	for _, r := range blockedRanges {
+		if r.prefix.Contains(addr) {
+			return r.name, true
+		}
+	}
+	if v4, kind, ok := embeddedIPv4(addr); ok {
+		if name, ok := blockedRange(v4); ok {
+			return kind + " " + name, true
+		}
+	}
+	return "", false
+}
+
+// embeddedIPv4 returns the IPv4 address a NAT64 (64:ff9b::/96) or 6to4
+// (2002::/16) address reaches on a dual-stack host, e.g. 127.0.0.1 for
+// 64:ff9b::7f00:1.
+func embeddedIPv4(addr netip.Addr) (netip.Addr, string, bool) {
+	b := addr.As16()
+	switch {
+	case nat64Prefix.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[12:16])), "NAT64", true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[2:6])), "6to4", true
+	}
+	return netip.Addr{}, "", false
+}
+
+// checkAddr is run against every address the dialer actually connects to,
+// after name resolution, so DNS rebinding cannot sneak a hostname past the
+// destination policy. Blocked ranges are only reachable when an allow rule
+// names a CIDR that contains the address.
+func checkAddr(policy *Policy, ap netip.AddrPort) error {
+	addr := ap.Addr().Unmap()
+	if decision, ok := policy.evaluateAddr(addr, int(ap.Port())); ok {
+		if !decision.Allow {
+			return &BlockedAddrError{Addr: ap, Reason: decision.String()}
+		}
+		return nil
+	}
+	if name, ok := blockedRange(addr); ok {
+		return &BlockedAddrError{Addr: ap, Reason: name + " address"}
+	}
+	return nil
+}
+
+func dialer(policy *Policy) *net.Dialer {
+	return &net.Dialer{
+		Timeout: dialTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return checkAddr(policy, ap)
+		},
+	}
+}
+
+// dial connects to host:port, through the upstream the policy picks for it
+// if any.
+func (st *Settings) dial(ctx context.Context, host string, port int) (net.Conn, error) {
+	return st.dialPolicy(ctx, st.policy(), host, port)
+}
+
+// dialPolicy connects to host:port as policy allows and routes it.
+func (st *Settings) dialPolicy(ctx context.Context, policy *Policy, host string, port int) (net.Conn, error) {
+	if via := policy.Evaluate(host, port).Via; len(via) != 0 {
+		return st.Upstreams.dialVia(ctx, via, policy, host, port)
+	}
+	return dialer(policy).DialContext(ctx, "tcp", net.JoinHostPort(host, fmt.Sprintf("%d", port)))
+}
+
+// dialFailureReason classifies a dial error for metrics and logs.
+func dialFailureReason(err error) string {
+	var blocked *BlockedAddrError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var upstreamErr *UpstreamError
+	switch {
+	case errors.As(err, &blocked):
+		return failDialBlocked
+	case errors.As(err, &dnsErr):
+		return failDialDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return failDialRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return failDialTimeout
+	case errors.As(err, &upstreamErr):
+		return failDialUpstream
+	}
+	return failDialError
+}
@@ -0,0 +1,114 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestBlockedRange(t *testing.T) {
+	tests := []struct {
+		addr    string
+		blocked bool
+		name    string
+	}{
+		{"127.0.0.1", true, "loopback"},
+		{"10.1.2.3", true, "private"},
+		{"172.31.255.255", true, "private"},
+		{"172.32.0.1", false, ""},
+		{"192.168.0.1", true, "private"},
+		{"169.254.169.254", true, "link-local"},
+		{"100.64.0.1", true, "carrier-grade NAT"},
+		{"0.0.0.0", true, "this network"},
+		{"224.0.0.1", true, "multicast"},
+		{"255.255.255.255", true, "reserved"},
+		{"8.8.8.8", false, ""},
+		{"::", true, "unspecified"},
+		{"::1", true, "loopback"},
+		{"::ffff:127.0.0.1", true, "loopback"},
+		{"::ffff:8.8.8.8", false, ""},
+		{"fd00::1", true, "unique-local"},
+		{"fe80::1", true, "link-local"},
+		{"ff02::1", true, "multicast"},
+		{"2001:4860:4860::8888", false, ""},
+		{"64:ff9b::7f00:1", true, "NAT64 loopback"},
+		{"64:ff9b::a9fe:a9fe", true, "NAT64 link-local"},
+		{"64:ff9b::808:808", false, ""},
+		{"64:ff9b:1::1", true, "local-use NAT64"},
+		{"2002:7f00:1::1", true, "6to4 loopback"},
+		{"2002:c0a8:101::", true, "6to4 private"},
+		{"2002:808:808::1", false, ""},
+	}
+	for _, tt := range tests {
+		name, blocked := blockedRange(netip.MustParseAddr(tt.addr))
+		if blocked != tt.blocked || name != tt.name {
+			t.Errorf("blockedRange(%s) = %q, %v, want %q, %v", tt.addr, name, blocked, tt.name, tt.blocked)
+		}
+	}
+}
+
+func TestEmbeddedIPv4(t *testing.T) {
+	tests := []struct {
+		addr string
+		v4   string
+		kind string
+	}{
+		{"64:ff9b::c000:201", "192.0.2.1", "NAT64"},
+		{"64:ff9b::192.0.2.1", "192.0.2.1", "NAT64"},
+		{"2002:c000:201::1", "192.0.2.1", "6to4"},
+		{"2002:c000:201:ffff::", "192.0.2.1", "6to4"},
+		{"64:ff9b:0:0:1::c000:201", "", ""},
+		{"2001:db8::1", "", ""},
+		{"192.0.2.1", "", ""},
+	}
+	for _, tt := range tests {
+		v4, kind, ok := embeddedIPv4(netip.MustParseAddr(tt.addr))
+		if ok != (len(tt.v4) != 0) {
+			t.Errorf("embeddedIPv4(%s) ok = %v", tt.addr, ok)
+			continue
+		}
+		if ok && (v4 != netip.MustParseAddr(tt.v4) || kind != tt.kind) {
+			t.Errorf("embeddedIPv4(%s) = %s, %s, want %s, %s", tt.addr, v4, kind, tt.v4, tt.kind)
+		}
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	p, err := NewPolicy(PolicyConfig{Rules: []RuleConfig{
+		{Action: "deny", CIDRs: []string{"10.0.0.5"}},
+		{Action: "allow", CIDRs: []string{"10.0.0.0/24"}, Ports: []string{"22"}},
+		{Action: "allow", CIDRs: []string{"64:ff9b::a00:100/120"}},
+		{Action: "deny", CIDRs: []string{"203.0.113.0/24"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"10.0.0.1:22", true},
+		{"[::ffff:10.0.0.1]:22", true},
+		{"10.0.0.1:23", false},
+		{"10.0.0.5:22", false},
+		{"10.0.1.1:22", false},
+		{"[64:ff9b::a00:101]:22", true},
+		{"[64:ff9b::a00:201]:22", false},
+		{"127.0.0.1:22", false},
+		{"203.0.113.7:22", false},
+		{"198.51.100.7:22", true},
+	}
+	for _, tt := range tests {
+		err := checkAddr(p, netip.MustParseAddrPort(tt.addr))
+		if (err == nil) != tt.ok {
+			t.Errorf("checkAddr(%s) = %v, want ok %v", tt.addr, err, tt.ok)
+		}
+		var blocked *BlockedAddrError
+		if err != nil && !errors.As(err, &blocked) {
+			t.Errorf("checkAddr(%s) = %T, want *BlockedAddrError", tt.addr, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCanaryTimeout = 5 * time.Second
+	// canaryCacheTTL spaces canary dials out, an orchestrator polling
+	// /readyz from many places must not turn into a dial storm.
+	canaryCacheTTL = 10 * time.Second
+)
+
+// HealthConfig configures /readyz.
+type HealthConfig struct {
+	// Canary is an optional host:port /readyz dials, through the destination
+	// policy and upstreams like a tunnel would, to check the server can
+	// reach out. The result is cached for 10s.
+	Canary string `yaml:"canary"`
+	// CanaryTimeout bounds the canary dial, 5s when zero.
+	CanaryTimeout time.Duration `yaml:"canary_timeout"`
+}
+
+func (c *HealthConfig) validate() error {
+	if len(c.Canary) != 0 {
+		host, port, err := net.SplitHostPort(c.Canary)
+		if err != nil {
+			return fmt.Errorf("health.canary: %w", err)
+		}
+		if p, err := strconv.Atoi(port); err != nil || len(host) == 0 || p < 1 || p > 65535 {
+			return fmt.Errorf("health.canary: bad address %q", c.Canary)
+		}
+	}
+	if c.CanaryTimeout < 0 {
+		return fmt.Errorf("health.canary_timeout: must not be negative")
+	}
+	return nil
+}
+
+func (c *HealthConfig) canaryTimeout() time.Duration {
+	if c.CanaryTimeout > 0 {
+		return c.CanaryTimeout
+	}
+	return defaultCanaryTimeout
+}
+
+// BuildInfo is served on /version.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	GoVersion string `json:"go_version"`
+	// BundleSHA256 identifies the embedded web page, see bundleHash.
+	BundleSHA256 string `json:"bundle_sha256"`
+}
+
+// buildInfo fills in what the binary knows about itself, version is the
+// one set at link time and may be empty.
+func buildInfo(version string) BuildInfo {
+	info := BuildInfo{Version: version, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if len(info.Version) == 0 {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				info.Revision = s.Value
+			}
+		}
+	}
+	if len(info.Version) == 0 {
+		info.Version = "unknown"
+	}
+	return info
+}
+
+// bundleHash hashes the name, size and content of every file in fsys in
+// lexical order, so any change to the web page changes the hash.
+func bundleHash(fsys fs.FS) (string, error) {
+	h := sha256.New()
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		f, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", path, st.Size())
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// canaryProbe caches the result of the last canary dial.
+type canaryProbe struct {
+	mu     sync.Mutex
+	target string
+	at     time.Time
+	err    error
+}
+
+// check dials the canary of st unless a result for the same target is
+// fresh. Concurrent callers wait for the one dial in flight.
+func (c *canaryProbe) check(ctx context.Context, st *Settings) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.target == st.Health.Canary && time.Since(c.at) < canaryCacheTTL {
+		return c.err
+	}
+	host, portStr, _ := net.SplitHostPort(st.Health.Canary)
+	port, _ := strconv.Atoi(portStr)
+	ctx, cancel := context.WithTimeout(ctx, st.Health.canaryTimeout())
+	defer cancel()
+	conn, err := st.dial(ctx, host, port)
+	if err == nil {
+		conn.Close()
+	}
+	c.target, c.at, c.err = st.Health.Canary, time.Now(), err
+	return err
+}
+
+// healthz reports the process is up.
+func (s *WsToTcpServer) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// readyz reports whether new tunnels are accepted: it fails while draining
+// and, when a canary is configured, while it cannot be dialed.
+func (s *WsToTcpServer) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if s.draining.Load() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if st := s.current(); len(st.Health.Canary) != 0 {
+		if err := s.canary.check(r.Context(), st); err != nil {
+			s.logger().Warn("canary dial failed", "canary", st.Health.Canary, "error", err)
+			http.Error(w, "canary "+st.Health.Canary+": "+dialFailureReason(err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (s *WsToTcpServer) version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.build)
+}
@@ -0,0 +1,51 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func probe(handler http.HandlerFunc) int {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/", nil))
+	return rec.Code
+}
+
+func TestReadyzDraining(t *testing.T) {
+	s, _ := newTestServer(t, &Config{})
+	if code := probe(s.readyz); code != http.StatusOK {
+		t.Errorf("readyz: status %d", code)
+	}
+	s.Shutdown()
+	if code := probe(s.readyz); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz while draining: status %d", code)
+	}
+	if code := probe(s.healthz); code != http.StatusOK {
+		t.Errorf("healthz while draining: status %d", code)
+	}
+}
+
+func TestReadyzCanary(t *testing.T) {
+	port := muxTestTarget(t, func(net.Conn) {})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+	for canary, want := range map[string]int{
+		net.JoinHostPort("127.0.0.1", strconv.Itoa(port)): http.StatusOK,
+		closed: http.StatusServiceUnavailable,
+	} {
+		s, _ := newTestServer(t, &Config{Health: HealthConfig{Canary: canary}})
+		if code := probe(s.readyz); code != want {
+			t.Errorf("canary %s: status %d, want %d", canary, code, want)
+		}
+	}
+}
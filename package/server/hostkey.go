@@ -0,0 +1,310 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	HostKeyLog   = "log"
+	HostKeyBlock = "block"
+
+	// CloseHostKeyChanged closes tunnels to a target whose host key changed
+	// when host_keys.on_change is block.
+	CloseHostKeyChanged = 4004
+)
+
+// SSH message numbers of the cleartext start of a session.
+const (
+	sshMsgNewKeys = 21
+	// sshMsgKexReply is KEXDH_REPLY and KEX_ECDH_REPLY, and also
+	// KEX_DH_GEX_GROUP, which carries no host key.
+	sshMsgKexReply    = 31
+	sshMsgKexGexReply = 33
+
+	// maxSSHPreamble bounds the lines a server may send before its version
+	// banner, maxSSHPacket the cleartext packets, as in RFC 4253.
+	maxSSHPreamble = 8 << 10
+	maxSSHPacket   = 35000
+)
+
+// HostKeyConfig tracks the host key each target presents. The key exchange
+// reply crosses the proxy in cleartext before NEWKEYS, so the proxy sees the
+// key the browser is asked to trust and can tell when it changes, a second
+// line of defense next to the browser's fingerprint prompt.
+type HostKeyConfig struct {
+	// Store is the JSON file known host keys are kept in, tracking is off
+	// when it is empty. The first key a target presents is recorded.
+	Store string `yaml:"store"`
+	// OnChange is "log" (the default), which logs a changed key and sends
+	// an admin event, or "block", which also closes the tunnel before the
+	// browser receives the key.
+	OnChange string `yaml:"on_change"`
+}
+
+// HostKeys is a compiled HostKeyConfig.
+type HostKeys struct {
+	block bool
+	store *hostKeyStore
+}
+
+// KnownHostKey is a recorded host key.
+type KnownHostKey struct {
+	Type        string    `json:"type"`
+	Fingerprint string    `json:"fingerprint"`
+	FirstSeen   time.Time `json:"first_seen"`
+}
+
+// hostKeyStore is the JSON file of known host keys, keyed by host:port.
+type hostKeyStore struct {
+	path string
+	mu   sync.Mutex
+	keys map[string]KnownHostKey
+}
+
+// NewHostKeys loads the store of cfg, it returns nil when tracking is off.
+func NewHostKeys(cfg HostKeyConfig) (*HostKeys, error) {
+	if len(cfg.Store) == 0 {
+		if len(cfg.OnChange) != 0 {
+			return nil, errors.New("host_keys.on_change: needs host_keys.store")
+		}
+		return nil, nil
+	}
+	h := &HostKeys{}
+	switch cfg.OnChange {
+	case "", HostKeyLog:
+	case HostKeyBlock:
+		h.block = true
+	default:
+		return nil, fmt.Errorf("host_keys.on_change: want %q or %q, got %q", HostKeyLog, HostKeyBlock, cfg.OnChange)
+	}
+	h.store = &hostKeyStore{path: cfg.Store, keys: make(map[string]KnownHostKey)}
+	data, err := os.ReadFile(cfg.Store)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("host_keys.store: %w", err)
+	case len(bytes.TrimSpace(data)) != 0:
+		if err := json.Unmarshal(data, &h.store.keys); err != nil {
+			return nil, fmt.Errorf("host_keys.store: parse %s: %w", cfg.Store, err)
+		}
+	}
+	return h, nil
+}
+
+// adopt takes over the store of prev when both use the same file, so
+// tunnels of either settings write through one store, with the entries
+// just read from the file.
+func (h *HostKeys) adopt(prev *HostKeys) {
+	if h == nil || prev == nil || prev.store.path != h.store.path {
+		return
+	}
+	prev.store.mu.Lock()
+	prev.store.keys = h.store.keys
+	prev.store.mu.Unlock()
+	h.store = prev.store
+}
+
+// check records key as the host key of target unless one is known. It
+// returns the known key when key differs from it.
+func (st *hostKeyStore) check(target string, key ssh.PublicKey) (known *KnownHostKey, recorded bool, err error) {
+	fp := ssh.FingerprintSHA256(key)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if k, ok := st.keys[target]; ok {
+		if k.Fingerprint != fp {
+			return &k, false, nil
+		}
+		return nil, false, nil
+	}
+	st.keys[target] = KnownHostKey{Type: key.Type(), Fingerprint: fp, FirstSeen: time.Now().UTC()}
+	return nil, true, st.save()
+}
+
+// forget removes the key of target, the next one it presents is recorded.
+func (st *hostKeyStore) forget(target string) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.keys[target]; !ok {
+		return false, nil
+	}
+	delete(st.keys, target)
+	return true, st.save()
+}
+
+// list returns the known keys by target.
+func (st *hostKeyStore) list() map[string]KnownHostKey {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	keys := make(map[string]KnownHostKey, len(st.keys))
+	for target, k := range st.keys {
+		keys[target] = k
+	}
+	return keys
+}
+
+// save writes the store through a temporary file so a crash never leaves
+// it half written. st.mu must be held.
+func (st *hostKeyStore) save() error {
+	data, err := json.MarshalIndent(st.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(st.path), filepath.Base(st.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), st.path)
+}
+
+var errHostKeyChanged = errors.New("target host key changed")
+
+// checkHostKey compares the host key t's target presented with the known
+// one. It returns an error when the tunnel must be closed.
+func (s *WsToTcpServer) checkHostKey(t *tunnel, hk *HostKeys, key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		// Certificates are renewed, the key they certify stays.
+		key = cert.Key
+	}
+	fp := ssh.FingerprintSHA256(key)
+	t.mu.Lock()
+	t.hostKey = fp
+	t.mu.Unlock()
+	target := net.JoinHostPort(strings.ToLower(t.host), strconv.Itoa(t.port))
+	known, recorded, err := hk.store.check(target, key)
+	if err != nil {
+		s.logger().Error("can't save host key", "target", target, "error", err)
+	}
+	if recorded {
+		s.logger().Info("recorded host key", "target", target, "type", key.Type(), "fingerprint", fp)
+	}
+	if known == nil {
+		return nil
+	}
+	s.logger().Warn("host key changed", "id", t.id, "target", target, "client_ip", t.clientIP, "user", t.user,
+		"known_fingerprint", known.Fingerprint, "fingerprint", fp, "blocked", hk.block)
+	s.metrics.hostKeyChanged()
+	s.events.publishHostKeyChange(t, known.Fingerprint)
+	if hk.block {
+		t.closeWith(CloseHostKeyChanged, errHostKeyChanged.Error())
+		return errHostKeyChanged
+	}
+	return nil
+}
+
+// sshWatcher reads the target side of a tunnel and follows the cleartext
+// start of an SSH session, the version banner and the binary packets up to
+// NEWKEYS, to hand the host key of the key exchange reply to onHostKey.
+// Bytes are passed on as read, an error of onHostKey withholds the bytes
+// that completed the reply. It stops looking at anything it does not
+// understand.
+type sshWatcher struct {
+	IReaderWithTimeout
+	onHostKey func(ssh.PublicKey) error
+
+	buf       []byte
+	preamble  int
+	banner    string
+	hasBanner bool
+	done      bool
+}
+
+func (w *sshWatcher) Read(p []byte) (int, error) {
+	n, err := w.IReaderWithTimeout.Read(p)
+	if n > 0 && !w.done {
+		if ferr := w.feed(p[:n]); ferr != nil {
+			return 0, ferr
+		}
+	}
+	return n, err
+}
+
+func (w *sshWatcher) stop() {
+	w.done, w.buf = true, nil
+}
+
+func (w *sshWatcher) feed(p []byte) error {
+	w.buf = append(w.buf, p...)
+	for !w.hasBanner {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			if w.preamble+len(w.buf) > maxSSHPreamble {
+				w.stop()
+			}
+			return nil
+		}
+		line := strings.TrimRight(string(w.buf[:i]), "\r")
+		w.preamble += i + 1
+		w.buf = w.buf[i+1:]
+		if strings.HasPrefix(line, "SSH-") {
+			w.banner, w.hasBanner = line, true
+		} else if w.preamble > maxSSHPreamble {
+			w.stop()
+			return nil
+		}
+	}
+	for len(w.buf) >= 5 {
+		length := int(binary.BigEndian.Uint32(w.buf))
+		padding := int(w.buf[4])
+		if length > maxSSHPacket || padding+2 > length {
+			w.stop()
+			return nil
+		}
+		if len(w.buf) < 4+length {
+			return nil
+		}
+		payload := w.buf[5 : 4+length-padding]
+		w.buf = w.buf[4+length:]
+		switch payload[0] {
+		case sshMsgNewKeys:
+			w.stop()
+		case sshMsgKexReply, sshMsgKexGexReply:
+			if key := kexReplyHostKey(payload); key != nil {
+				w.stop()
+				return w.onHostKey(key)
+			}
+		}
+	}
+	return nil
+}
+
+// kexReplyHostKey returns the host key a key exchange reply starts with,
+// nil when payload carries none, e.g. a KEX_DH_GEX_GROUP.
+func kexReplyHostKey(payload []byte) ssh.PublicKey {
+	if len(payload) < 5 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint32(payload[1:5]))
+	if n > len(payload)-5 {
+		return nil
+	}
+	key, err := ssh.ParsePublicKey(payload[5 : 5+n])
+	if err != nil {
+		return nil
+	}
+	return key
+}
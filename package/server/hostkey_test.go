@@ -0,0 +1,214 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// watchedConn reads through an sshWatcher.
+type watchedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c watchedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// tcpPipe returns both ends of a loopback TCP connection. Unlike net.Pipe
+// it buffers writes, which SSH needs as both peers send their banner first.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+func testHostKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestSSHWatcherHandshake(t *testing.T) {
+	hostKey := testHostKey(t)
+	for _, kex := range []string{
+		"curve25519-sha256",
+		"ecdh-sha2-nistp256",
+		"diffie-hellman-group14-sha256",
+		"diffie-hellman-group-exchange-sha256",
+	} {
+		serverConn, clientConn := tcpPipe(t)
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(hostKey)
+		config.KeyExchanges = []string{kex}
+		go func() {
+			defer serverConn.Close()
+			if conn, chans, reqs, err := ssh.NewServerConn(serverConn, config); err == nil {
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "")
+				}
+				conn.Close()
+			}
+		}()
+
+		var seen []ssh.PublicKey
+		w := &sshWatcher{IReaderWithTimeout: clientConn, onHostKey: func(key ssh.PublicKey) error {
+			seen = append(seen, key)
+			return nil
+		}}
+		conn, _, _, err := ssh.NewClientConn(watchedConn{Conn: clientConn, r: w}, "target", &ssh.ClientConfig{
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Config:          ssh.Config{KeyExchanges: []string{kex}},
+		})
+		if err != nil {
+			t.Fatalf("%s: handshake: %v", kex, err)
+		}
+		conn.Close()
+		if len(seen) != 1 || !bytes.Equal(seen[0].Marshal(), hostKey.PublicKey().Marshal()) {
+			t.Errorf("%s: watcher saw %d keys, want the host key once", kex, len(seen))
+		}
+		if !w.done || w.banner != "SSH-2.0-Go" {
+			t.Errorf("%s: done %v, banner %q", kex, w.done, w.banner)
+		}
+	}
+}
+
+func TestSSHWatcherBlocks(t *testing.T) {
+	serverConn, clientConn := tcpPipe(t)
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(testHostKey(t))
+	go func() {
+		defer serverConn.Close()
+		ssh.NewServerConn(serverConn, config)
+	}()
+	errBlocked := errors.New("blocked")
+	w := &sshWatcher{IReaderWithTimeout: clientConn, onHostKey: func(ssh.PublicKey) error { return errBlocked }}
+	var verified bool
+	_, _, _, err := ssh.NewClientConn(watchedConn{Conn: clientConn, r: w}, "target", &ssh.ClientConfig{
+		HostKeyCallback: func(string, net.Addr, ssh.PublicKey) error {
+			verified = true
+			return nil
+		},
+	})
+	clientConn.Close()
+	if err == nil || verified {
+		t.Errorf("handshake = %v, host key verified %v, want the reply withheld", err, verified)
+	}
+}
+
+// sshPacket frames payload as a cleartext SSH binary packet.
+func sshPacket(payload []byte) []byte {
+	padding := 8 - (5+len(payload))%8
+	if padding < 4 {
+		padding += 8
+	}
+	p := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)+padding))
+	p = append(p, byte(padding))
+	p = append(p, payload...)
+	return append(p, make([]byte, padding)...)
+}
+
+// sshString encodes b as an SSH string.
+func sshString(b []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(b))), b...)
+}
+
+func TestSSHWatcherFeed(t *testing.T) {
+	key := testHostKey(t).PublicKey()
+	kexInit := sshPacket(append([]byte{20}, make([]byte, 40)...))
+	reply := sshPacket(append(append([]byte{sshMsgKexReply}, sshString(key.Marshal())...), sshString([]byte("f"))...))
+	gexGroup := sshPacket(append(append([]byte{sshMsgKexReply}, sshString([]byte{0x7f, 0xff})...), sshString([]byte{2})...))
+	gexReply := sshPacket(append([]byte{sshMsgKexGexReply}, sshString(key.Marshal())...))
+	newKeys := sshPacket([]byte{sshMsgNewKeys})
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name   string
+		stream []byte
+		found  bool
+	}{
+		{"kex reply", join([]byte("SSH-2.0-x\r\n"), kexInit, reply), true},
+		{"preamble", join([]byte("welcome\r\nSSH-2.0-x\r\n"), kexInit, reply), true},
+		{"gex", join([]byte("SSH-2.0-x\r\n"), kexInit, gexGroup, gexReply), true},
+		{"after newkeys", join([]byte("SSH-2.0-x\r\n"), kexInit, newKeys, reply), false},
+		{"no banner", join(kexInit, reply), false},
+		{"long preamble", join(bytes.Repeat([]byte("x\r\n"), maxSSHPreamble/3+1), []byte("SSH-2.0-x\r\n"), reply), false},
+		{"oversized packet", join([]byte("SSH-2.0-x\r\n"), []byte{0, 1, 0, 0, 4}, reply), false},
+		{"bad padding", join([]byte("SSH-2.0-x\r\n"), []byte{0, 0, 0, 8, 8}, make([]byte, 8), reply), false},
+		{"truncated reply", join([]byte("SSH-2.0-x\r\n"), reply[:len(reply)-20]), false},
+	}
+	for _, tt := range tests {
+		for _, chunk := range []int{1, 7, len(tt.stream)} {
+			var found int
+			w := &sshWatcher{onHostKey: func(got ssh.PublicKey) error {
+				if !bytes.Equal(got.Marshal(), key.Marshal()) {
+					t.Errorf("%s: wrong key", tt.name)
+				}
+				found++
+				return nil
+			}}
+			for p := tt.stream; len(p) != 0 && !w.done; {
+				n := min(chunk, len(p))
+				if err := w.feed(p[:n]); err != nil {
+					t.Fatalf("%s: %v", tt.name, err)
+				}
+				p = p[n:]
+			}
+			if (found == 1) != tt.found || found > 1 {
+				t.Errorf("%s in chunks of %d: found the key %d times, want %v", tt.name, chunk, found, tt.found)
+			}
+		}
+	}
+}
+
+func TestKexReplyHostKey(t *testing.T) {
+	key := testHostKey(t).PublicKey()
+	tests := []struct {
+		name    string
+		payload []byte
+		ok      bool
+	}{
+		{"reply", append([]byte{sshMsgKexReply}, sshString(key.Marshal())...), true},
+		{"empty", nil, false},
+		{"short", []byte{sshMsgKexReply, 0, 0}, false},
+		{"length past end", append([]byte{sshMsgKexReply, 0, 0, 1, 0}, key.Marshal()...), false},
+		{"not a key", append([]byte{sshMsgKexReply}, sshString([]byte("ssh-ed25519 garbage"))...), false},
+		{"dh group", append([]byte{sshMsgKexReply}, sshString([]byte{0x7f, 0xff})...), false},
+	}
+	for _, tt := range tests {
+		if got := kexReplyHostKey(tt.payload); (got != nil) != tt.ok {
+			t.Errorf("%s: kexReplyHostKey = %v, want a key %v", tt.name, got, tt.ok)
+		}
+	}
+}
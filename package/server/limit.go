@@ -0,0 +1,170 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	limitPruneInterval = time.Minute
+	// concurrencyRetryAfter is suggested to clients refused because too many
+	// tunnels are open, there is no way to know when one will close.
+	concurrencyRetryAfter = 10 * time.Second
+)
+
+var (
+	ErrRateLimited    = errors.New("too many new tunnels")
+	ErrTooManyTunnels = errors.New("too many open tunnels")
+)
+
+// LimitConfig bounds how many tunnels are opened. Zero values disable the
+// corresponding limit.
+type LimitConfig struct {
+	// RatePerIP is the number of new tunnels per second a client IP may
+	// open, with bursts of up to BurstPerIP.
+	RatePerIP  float64 `yaml:"rate_per_ip"`
+	BurstPerIP int     `yaml:"burst_per_ip"`
+	// MaxPerIP caps the concurrent tunnels of one client IP.
+	MaxPerIP int `yaml:"max_per_ip"`
+	// MaxTotal caps the concurrent tunnels of the whole server.
+	MaxTotal int `yaml:"max_total"`
+}
+
+func (c *LimitConfig) validate() error {
+	switch {
+	case c.RatePerIP < 0:
+		return fmt.Errorf("limits.rate_per_ip: must not be negative")
+	case c.BurstPerIP < 0:
+		return fmt.Errorf("limits.burst_per_ip: must not be negative")
+	case c.MaxPerIP < 0:
+		return fmt.Errorf("limits.max_per_ip: must not be negative")
+	case c.MaxTotal < 0:
+		return fmt.Errorf("limits.max_total: must not be negative")
+	}
+	return nil
+}
+
+// Limiter enforces a LimitConfig.
+type Limiter struct {
+	cfg   LimitConfig
+	state *limitState
+}
+
+// limitState is kept across reloads, see adopt.
+type limitState struct {
+	mu        sync.Mutex
+	total     int
+	clients   map[string]*clientLimit
+	lastPrune time.Time
+}
+
+type clientLimit struct {
+	rate     *rate.Limiter
+	active   int
+	lastSeen time.Time
+}
+
+func NewLimiter(cfg LimitConfig) (*Limiter, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.RatePerIP > 0 && cfg.BurstPerIP == 0 {
+		cfg.BurstPerIP = max(1, int(cfg.RatePerIP))
+	}
+	return &Limiter{
+		cfg:   cfg,
+		state: &limitState{clients: make(map[string]*clientLimit)},
+	}, nil
+}
+
+// adopt takes over the open tunnel counts and token buckets of prev, so a
+// reload neither forgets the open tunnels nor refills the buckets. It must
+// be called before l is used.
+func (l *Limiter) adopt(prev *Limiter) {
+	if prev == nil || prev == l {
+		return
+	}
+	l.state = prev.state
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	for _, c := range l.state.clients {
+		switch {
+		case l.cfg.RatePerIP == 0:
+			c.rate = nil
+		case c.rate == nil:
+			c.rate = rate.NewLimiter(rate.Limit(l.cfg.RatePerIP), l.cfg.BurstPerIP)
+		default:
+			c.rate.SetLimit(rate.Limit(l.cfg.RatePerIP))
+			c.rate.SetBurst(l.cfg.BurstPerIP)
+		}
+	}
+}
+
+// acquire reserves a tunnel slot for ip. On success release must be called
+// once the tunnel is closed, on failure retryAfter suggests when to retry.
+func (l *Limiter) acquire(ip string) (release func(), retryAfter time.Duration, err error) {
+	st := l.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	st.prune(now)
+	c := st.clients[ip]
+	if c == nil {
+		c = &clientLimit{}
+		if l.cfg.RatePerIP > 0 {
+			c.rate = rate.NewLimiter(rate.Limit(l.cfg.RatePerIP), l.cfg.BurstPerIP)
+		}
+		st.clients[ip] = c
+	}
+	c.lastSeen = now
+
+	if l.cfg.MaxTotal > 0 && st.total >= l.cfg.MaxTotal {
+		return nil, concurrencyRetryAfter, ErrTooManyTunnels
+	}
+	if l.cfg.MaxPerIP > 0 && c.active >= l.cfg.MaxPerIP {
+		return nil, concurrencyRetryAfter, ErrTooManyTunnels
+	}
+	if c.rate != nil {
+		r := c.rate.ReserveN(now, 1)
+		if delay := r.DelayFrom(now); delay > 0 {
+			r.CancelAt(now)
+			return nil, delay, ErrRateLimited
+		}
+	}
+
+	st.total++
+	c.active++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			st.mu.Lock()
+			st.total--
+			c.active--
+			c.lastSeen = time.Now()
+			st.mu.Unlock()
+		})
+	}, 0, nil
+}
+
+// prune forgets idle clients whose token bucket has refilled.
+func (st *limitState) prune(now time.Time) {
+	if now.Sub(st.lastPrune) < limitPruneInterval {
+		return
+	}
+	st.lastPrune = now
+	for ip, c := range st.clients {
+		if c.active == 0 && now.Sub(c.lastSeen) >= limitPruneInterval {
+			if c.rate == nil || c.rate.TokensAt(now) >= float64(c.rate.Burst()) {
+				delete(st.clients, ip)
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterConcurrency(t *testing.T) {
+	l, err := NewLimiter(LimitConfig{MaxPerIP: 2, MaxTotal: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var releases []func()
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"} {
+		release, _, err := l.acquire(ip)
+		if err != nil {
+			t.Fatalf("acquire(%s): %v", ip, err)
+		}
+		releases = append(releases, release)
+	}
+	if _, retryAfter, err := l.acquire("192.0.2.3"); !errors.Is(err, ErrTooManyTunnels) || retryAfter != concurrencyRetryAfter {
+		t.Errorf("acquire past max_total = %v, retry after %v", err, retryAfter)
+	}
+	releases[2]()
+	releases[2]()
+	if _, _, err := l.acquire("192.0.2.1"); !errors.Is(err, ErrTooManyTunnels) {
+		t.Errorf("acquire past max_per_ip = %v", err)
+	}
+	release, _, err := l.acquire("192.0.2.3")
+	if err != nil {
+		t.Fatalf("acquire after a release: %v", err)
+	}
+	release()
+	releases[0]()
+	if release, _, err := l.acquire("192.0.2.1"); err != nil {
+		t.Errorf("acquire after a release of the same IP: %v", err)
+	} else {
+		release()
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l, err := NewLimiter(LimitConfig{RatePerIP: 1, BurstPerIP: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := l.acquire("192.0.2.1"); err != nil {
+			t.Fatalf("acquire %d within the burst: %v", i, err)
+		}
+	}
+	_, retryAfter, err := l.acquire("192.0.2.1")
+	if !errors.Is(err, ErrRateLimited) || retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("acquire past the burst = %v, retry after %v", err, retryAfter)
+	}
+	// A refusal does not spend a token.
+	if _, again, _ := l.acquire("192.0.2.1"); again > retryAfter {
+		t.Errorf("retry after grew from %v to %v", retryAfter, again)
+	}
+	if _, _, err := l.acquire("192.0.2.2"); err != nil {
+		t.Errorf("another IP: %v", err)
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	l, err := NewLimiter(LimitConfig{RatePerIP: 10, MaxPerIP: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, _, err := l.acquire("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, _, err := l.acquire("192.0.2.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed()
+	st := l.state
+	st.prune(time.Now().Add(2 * limitPruneInterval))
+	if _, ok := st.clients["192.0.2.1"]; !ok {
+		t.Error("pruned a client with an open tunnel")
+	}
+	if _, ok := st.clients["192.0.2.2"]; ok {
+		t.Error("kept an idle client")
+	}
+	open()
+}
+
+func TestLimiterAdopt(t *testing.T) {
+	prev, err := NewLimiter(LimitConfig{RatePerIP: 1, BurstPerIP: 1, MaxPerIP: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, _, err := prev.acquire("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := NewLimiter(LimitConfig{RatePerIP: 1, BurstPerIP: 1, MaxPerIP: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.adopt(prev)
+	// The open tunnel counts against the new limit, and the spent token
+	// is not refilled by the reload.
+	if _, _, err := next.acquire("192.0.2.1"); !errors.Is(err, ErrTooManyTunnels) {
+		t.Errorf("acquire with the tunnel of the old limiter open = %v", err)
+	}
+	release()
+	if _, _, err := next.acquire("192.0.2.1"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("acquire with the token spent before the reload = %v", err)
+	}
+
+	unlimited, err := NewLimiter(LimitConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlimited.adopt(next)
+	if release, _, err := unlimited.acquire("192.0.2.1"); err != nil {
+		t.Errorf("acquire once the rate limit is lifted: %v", err)
+	} else {
+		release()
+	}
+}
@@ -0,0 +1,243 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// systemdFirstFD is the first descriptor systemd passes, see sd_listen_fds(3).
+const systemdFirstFD = 3
+
+// ListenerConfig is one address the tunnel endpoint listens on.
+type ListenerConfig struct {
+	// Address is one of
+	//	host:port       a TCP address
+	//	unix:/path      a Unix domain socket, a stale socket file is replaced
+	//	systemd         every socket passed by systemd socket activation
+	//	systemd:name    the activated sockets with FileDescriptorName=name
+	Address string `yaml:"address"`
+	// Mode is the octal file mode of a Unix socket, e.g. "0660". The umask
+	// applies when it is empty.
+	Mode string `yaml:"mode"`
+}
+
+func (c *ListenerConfig) validate() error {
+	network, address := c.split()
+	switch network {
+	case "tcp":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("listeners: %w", err)
+		}
+	case "unix":
+		if len(address) == 0 {
+			return fmt.Errorf("listeners: %q needs a path", c.Address)
+		}
+	}
+	if len(c.Mode) != 0 {
+		if network != "unix" {
+			return fmt.Errorf("listeners: mode is only valid for unix sockets, not %q", c.Address)
+		}
+		if _, err := c.mode(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// split returns the network of the address, tcp, unix or systemd, and the
+// rest of it.
+func (c *ListenerConfig) split() (string, string) {
+	switch {
+	case strings.HasPrefix(c.Address, "unix:"):
+		return "unix", strings.TrimPrefix(c.Address, "unix:")
+	case c.Address == "systemd":
+		return "systemd", ""
+	case strings.HasPrefix(c.Address, "systemd:"):
+		return "systemd", strings.TrimPrefix(c.Address, "systemd:")
+	}
+	return "tcp", c.Address
+}
+
+func (c *ListenerConfig) mode() (os.FileMode, error) {
+	m, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("listeners: bad mode %q", c.Mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// ValidateListeners checks a listeners config section.
+func ValidateListeners(cfgs []ListenerConfig) error {
+	for i := range cfgs {
+		if err := cfgs[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listen opens the listeners for c, systemd addresses may yield several.
+func (c *ListenerConfig) listen() ([]net.Listener, error) {
+	network, address := c.split()
+	switch network {
+	case "systemd":
+		return systemdListeners(address)
+	case "unix":
+		var mode os.FileMode
+		if len(c.Mode) != 0 {
+			mode, _ = c.mode()
+		}
+		l, err := listenUnix(address, mode)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+// listenUnix listens on path, removing a socket left behind by a previous
+// run. Anything but a socket at path is left alone. With a mode the socket
+// is created in a private directory and given the mode there, then linked
+// to path, so it never accepts connections under looser permissions.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("listen unix %s: socket in use", path)
+		}
+		os.Remove(path)
+	}
+	if mode == 0 {
+		return net.Listen("unix", path)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return nil, fmt.Errorf("listen unix %s: %w", path, err)
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(private, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	// Unlike a rename, a link fails instead of replacing what appeared at
+	// path in the meantime.
+	if err := os.Link(private, path); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("listen unix %s: %w", path, err)
+	}
+	return &unixListener{UnixListener: l, path: path}, nil
+}
+
+// unixListener removes the socket it was linked to on Close.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+type activatedListener struct {
+	name string
+	l    net.Listener
+	used bool
+}
+
+var systemd struct {
+	once      sync.Once
+	mu        sync.Mutex
+	listeners []*activatedListener
+	err       error
+}
+
+// systemdListeners hands out the sockets passed by systemd, all of them or
+// those named name. Each socket is handed out once.
+func systemdListeners(name string) ([]net.Listener, error) {
+	systemd.once.Do(func() {
+		systemd.listeners, systemd.err = activatedListeners()
+	})
+	if systemd.err != nil {
+		return nil, systemd.err
+	}
+	systemd.mu.Lock()
+	defer systemd.mu.Unlock()
+	var ls []net.Listener
+	for _, a := range systemd.listeners {
+		if !a.used && (len(name) == 0 || a.name == name) {
+			a.used = true
+			ls = append(ls, a.l)
+		}
+	}
+	if len(ls) == 0 {
+		if len(name) != 0 {
+			return nil, fmt.Errorf("no systemd socket named %q", name)
+		}
+		return nil, errors.New("no systemd sockets left")
+	}
+	return ls, nil
+}
+
+// activatedListeners reads the sockets passed by systemd socket activation,
+// the LISTEN_* variables are cleared so child processes do not see them.
+func activatedListeners() ([]*activatedListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("not started by systemd socket activation")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("systemd passed no sockets")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make([]*activatedListener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := systemdFirstFD + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && len(names[i]) != 0 {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor.
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %s: %w", name, err)
+		}
+		listeners = append(listeners, &activatedListener{name: name, l: l})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,152 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gw.sock")
+
+	// A socket left behind by a previous run is replaced.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	l, err := listenUnix(path, 0)
+	if err != nil {
+		t.Fatalf("over a stale socket: %v", err)
+	}
+	if c, err := net.Dial("unix", path); err != nil {
+		t.Errorf("dial: %v", err)
+	} else {
+		c.Close()
+	}
+
+	// One that still accepts connections is not.
+	if _, err := listenUnix(path, 0); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("over a socket in use: %v", err)
+	}
+	l.Close()
+
+	// Nor is anything but a socket.
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listenUnix(file, 0); err == nil {
+		l.Close()
+		t.Error("listened over a regular file")
+	}
+
+	l, err = listenUnix(path, 0660)
+	if err != nil {
+		t.Fatalf("with a mode: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket mode %v, want 0660", fi.Mode())
+	}
+	if l.Addr().String() != path {
+		t.Errorf("listener address %s, want %s", l.Addr(), path)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("%d entries in %s, want the socket and the file", len(entries), dir)
+	}
+	l.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket left after Close: %v", err)
+	}
+}
+
+func TestActivatedListenersEnv(t *testing.T) {
+	for _, env := range [][2]string{
+		{"", "1"},
+		{"1", "1"},
+		{strconv.Itoa(os.Getpid()), ""},
+		{strconv.Itoa(os.Getpid()), "0"},
+	} {
+		t.Setenv("LISTEN_PID", env[0])
+		t.Setenv("LISTEN_FDS", env[1])
+		if _, err := activatedListeners(); err == nil {
+			t.Errorf("LISTEN_PID=%q LISTEN_FDS=%q: no error", env[0], env[1])
+		}
+	}
+}
+
+// TestSystemdListeners runs itself with two sockets passed the way systemd
+// passes them, descriptors from 3 on belong to the runtime of this process.
+func TestSystemdListeners(t *testing.T) {
+	if addrs := os.Getenv("GOWASMSSH_TEST_SYSTEMD"); len(addrs) != 0 {
+		systemdChild(t, strings.Split(addrs, ","))
+		return
+	}
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, l.Addr().String())
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListeners$")
+	cmd.Env = append(os.Environ(),
+		"GOWASMSSH_TEST_SYSTEMD="+strings.Join(addrs, ","),
+		"LISTEN_FDS=2",
+		"LISTEN_FDNAMES=web:",
+	)
+	cmd.ExtraFiles = files
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("%v\n%s", err, out)
+	}
+}
+
+// systemdChild checks the sockets passed by TestSystemdListeners, the first
+// is named web.
+func systemdChild(t *testing.T, addrs []string) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	web, err := systemdListeners("web")
+	if err != nil || len(web) != 1 || web[0].Addr().String() != addrs[0] {
+		t.Fatalf("systemd:web = %v, %v", web, err)
+	}
+	if _, err := systemdListeners("web"); err == nil {
+		t.Error("systemd:web handed out twice")
+	}
+	rest, err := systemdListeners("")
+	if err != nil || len(rest) != 1 || rest[0].Addr().String() != addrs[1] {
+		t.Fatalf("systemd = %v, %v", rest, err)
+	}
+	if _, err := systemdListeners(""); err == nil {
+		t.Error("systemd with every socket handed out: no error")
+	}
+	if _, err := systemdListeners("LISTEN_FD_4"); err == nil {
+		t.Error("the unnamed socket handed out twice")
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if v, ok := os.LookupEnv(name); ok {
+			t.Errorf("%s=%s left in the environment", name, v)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// LogConfig controls the JSON log, which carries both server messages and
+// the per-tunnel access records.
+type LogConfig struct {
+	// Level is debug, info (default), warn or error.
+	Level string `yaml:"level"`
+	// File is appended to, stderr is used when empty.
+	File string `yaml:"file"`
+}
+
+// logLevel is shared by every logger NewLogger makes, so Apply can change
+// it at run time.
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if len(s) != 0 {
+		if err := level.UnmarshalText([]byte(s)); err != nil {
+			return level, fmt.Errorf("log.level: %w", err)
+		}
+	}
+	return level, nil
+}
+
+// NewLogger opens the configured output and returns a JSON logger. The
+// returned closer releases the log file. Its level follows the applied
+// Settings.
+func NewLogger(cfg LogConfig) (*slog.Logger, io.Closer, error) {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	logLevel.Set(level)
+	var out io.WriteCloser = nopCloser{os.Stderr}
+	if len(cfg.File) != 0 {
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+		if err != nil {
+			return nil, nil, fmt.Errorf("log.file: %w", err)
+		}
+		out = f
+	}
+	logger := slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: logLevel}))
+	return logger, out, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func (s *WsToTcpServer) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
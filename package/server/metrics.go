@@ -0,0 +1,198 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Failure reasons reported in gowasmssh_tunnels_failed_total.
+const (
+	failOrigin         = "origin"
+	failBadRequest     = "bad_request"
+	failTicket         = "ticket"
+	failPolicy         = "policy"
+	failRateLimited    = "rate_limited"
+	failTooManyTunnels = "too_many_tunnels"
+	failDialBlocked    = "dial_blocked"
+	failDialTimeout    = "dial_timeout"
+	failDialRefused    = "dial_refused"
+	failDialDNS        = "dial_dns"
+	failDialUpstream   = "dial_upstream"
+	failDialError      = "dial_error"
+	failNotSSH         = "not_ssh"
+)
+
+const (
+	dirIn  = "in"  // browser to target
+	dirOut = "out" // target to browser
+)
+
+var (
+	durationBuckets = []float64{1, 10, 60, 300, 900, 1800, 3600, 4 * 3600, 12 * 3600}
+	dialBuckets     = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+)
+
+// Metrics collects tunnel statistics and renders them in the Prometheus
+// text exposition format.
+type Metrics struct {
+	active atomic.Int64
+	opened atomic.Uint64
+	// hostKeyChanges counts targets seen with another host key.
+	hostKeyChanges atomic.Uint64
+	bytesIn        atomic.Uint64
+	bytesOut       atomic.Uint64
+
+	mu     sync.Mutex
+	failed map[string]uint64
+
+	tunnelDuration *histogram
+	dialDuration   *histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		failed:         make(map[string]uint64),
+		tunnelDuration: newHistogram(durationBuckets),
+		dialDuration:   newHistogram(dialBuckets),
+	}
+}
+
+func (m *Metrics) tunnelOpened() {
+	m.opened.Add(1)
+	m.active.Add(1)
+}
+
+func (m *Metrics) tunnelClosed(d time.Duration) {
+	m.active.Add(-1)
+	m.tunnelDuration.observe(d.Seconds())
+}
+
+func (m *Metrics) tunnelFailed(reason string) {
+	m.mu.Lock()
+	m.failed[reason]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) addBytes(dir string, n int) {
+	if dir == dirIn {
+		m.bytesIn.Add(uint64(n))
+	} else {
+		m.bytesOut.Add(uint64(n))
+	}
+}
+
+func (m *Metrics) hostKeyChanged() {
+	m.hostKeyChanges.Add(1)
+}
+
+func (m *Metrics) dialed(d time.Duration) {
+	m.dialDuration.observe(d.Seconds())
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	writeHeader(cw, "gowasmssh_tunnels_active", "gauge", "Number of open tunnels.")
+	fmt.Fprintf(cw, "gowasmssh_tunnels_active %d\n", m.active.Load())
+
+	writeHeader(cw, "gowasmssh_tunnels_opened_total", "counter", "Tunnels whose target connection was established.")
+	fmt.Fprintf(cw, "gowasmssh_tunnels_opened_total %d\n", m.opened.Load())
+
+	writeHeader(cw, "gowasmssh_tunnels_failed_total", "counter", "Tunnel requests that were refused, could not be dialed or did not speak SSH, by reason.")
+	m.mu.Lock()
+	reasons := make([]string, 0, len(m.failed))
+	for reason := range m.failed {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(cw, "gowasmssh_tunnels_failed_total{reason=%q} %d\n", reason, m.failed[reason])
+	}
+	m.mu.Unlock()
+
+	writeHeader(cw, "gowasmssh_tunnel_bytes_total", "counter", "Bytes relayed through tunnels; in is browser to target, out is target to browser.")
+	fmt.Fprintf(cw, "gowasmssh_tunnel_bytes_total{direction=%q} %d\n", dirIn, m.bytesIn.Load())
+	fmt.Fprintf(cw, "gowasmssh_tunnel_bytes_total{direction=%q} %d\n", dirOut, m.bytesOut.Load())
+
+	writeHeader(cw, "gowasmssh_host_key_changes_total", "counter", "Tunnels whose target presented another SSH host key than the known one.")
+	fmt.Fprintf(cw, "gowasmssh_host_key_changes_total %d\n", m.hostKeyChanges.Load())
+
+	writeHeader(cw, "gowasmssh_tunnel_duration_seconds", "histogram", "Lifetime of closed tunnels.")
+	m.tunnelDuration.write(cw, "gowasmssh_tunnel_duration_seconds")
+
+	writeHeader(cw, "gowasmssh_dial_duration_seconds", "histogram", "Time spent dialing tunnel targets that could be reached, failed dials are counted in gowasmssh_tunnels_failed_total.")
+	m.dialDuration.write(cw, "gowasmssh_dial_duration_seconds")
+	return cw.n, cw.err
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative uint64
+	for i, b := range h.bounds {
+		cumulative += h.buckets[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(b, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,459 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MuxProtocol is the WebSocket subprotocol under which one WebSocket to
+// /ws/mux carries many tunnels, called streams.
+//
+// Both directions are a sequence of frames, which may be split across or
+// share WebSocket messages:
+//
+//	type    uint8
+//	stream  uint32, big endian, chosen by the browser, never reused
+//	length  uint32, big endian, at most 32 KiB
+//	payload [length]byte
+//
+// The browser opens a stream with an open frame. The server answers with
+// opened once the stream passed the ticket, policy and limit checks, the
+// point where a plain tunnel would be upgraded, and dials the target
+// afterwards. Either side ends a stream with a close frame, the other side
+// answers with one unless it already sent its own. Refusals and tunnel ends
+// use the close codes of plain tunnels and, like them, are preceded by a
+// control message, carried in an error frame.
+//
+// Each side may send a stream at most 256 KiB of data frames ahead of the
+// window frames returning credit for the data the other side consumed.
+const MuxProtocol = "gowasmssh.mux.v1"
+
+// Mux frame types.
+const (
+	// muxOpen carries a JSON muxOpenRequest.
+	muxOpen = 1
+	// muxOpened has no payload.
+	muxOpened = 2
+	// muxData carries stream bytes.
+	muxData = 3
+	// muxWindow carries a uint32 of consumed bytes returned as credit.
+	muxWindow = 4
+	// muxClose carries a uint16 close code and a UTF-8 reason.
+	muxClose = 5
+	// muxError carries a JSON ControlMessage, sent before muxClose.
+	muxError = 6
+)
+
+const (
+	muxHeaderSize = 9
+	muxMaxPayload = 32 << 10
+	muxWindowSize = 256 << 10
+	// muxMaxStreams bounds the streams of one session, each tunnel is
+	// still counted against the connection limits.
+	muxMaxStreams = 256
+)
+
+// muxOpenRequest is the payload of an open frame, it names either a
+// catalog target or host and port.
+type muxOpenRequest struct {
+	Target string `json:"target,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Port   int    `json:"port,omitempty"`
+	Ticket string `json:"ticket,omitempty"`
+}
+
+// muxProtocolError ends the whole session.
+type muxProtocolError struct {
+	msg string
+}
+
+func (e *muxProtocolError) Error() string {
+	return "mux protocol error: " + e.msg
+}
+
+// muxHandler upgrades to a multiplexed session, the Origin is checked once
+// for the session and every stream is checked like a plain tunnel.
+func (s *WsToTcpServer) muxHandler(w http.ResponseWriter, r *http.Request) {
+	st := s.current()
+	if !s.checkUpgrade(w, r, st) {
+		return
+	}
+	if !slices.Contains(websocket.Subprotocols(r), MuxProtocol) {
+		http.Error(w, "the "+MuxProtocol+" subprotocol is required", http.StatusBadRequest)
+		return
+	}
+	if s.draining.Load() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := st.WebSocket.upgrader().Upgrade(w, r, http.Header{"Sec-WebSocket-Protocol": {MuxProtocol}})
+	if err != nil {
+		s.logger().Warn("upgrade failed", "path", r.URL.Path, "client_ip", clientIP(r), "error", err)
+		return
+	}
+	sess := &muxSession{
+		s:       s,
+		r:       r,
+		conn:    conn,
+		ws:      newWsStream(conn, st.WebSocket),
+		streams: make(map[uint32]*muxStream),
+	}
+	sess.serve()
+}
+
+// muxSession is one multiplexed WebSocket.
+type muxSession struct {
+	s    *WsToTcpServer
+	r    *http.Request
+	conn *websocket.Conn
+	ws   *wsStream
+	// wmu keeps frames whole, wsStream sends every Write as one message.
+	wmu sync.Mutex
+
+	mu       sync.Mutex
+	streams  map[uint32]*muxStream
+	draining bool
+}
+
+func (m *muxSession) serve() {
+	ctx, cancel := context.WithCancel(m.s.ctx)
+	defer cancel()
+	go m.ws.keepalive(ctx.Done())
+	go func() {
+		select {
+		case <-m.s.drain:
+			m.mu.Lock()
+			m.draining = true
+			idle := len(m.streams) == 0
+			m.mu.Unlock()
+			if idle {
+				m.closeDrained()
+			}
+		case <-ctx.Done():
+			m.conn.Close()
+		}
+	}()
+
+	err := m.readLoop()
+	var protoErr *muxProtocolError
+	if errors.As(err, &protoErr) {
+		m.s.logger().Warn("closing mux session", "client_ip", clientIP(m.r), "error", err)
+		writeClose(m.conn, websocket.CloseProtocolError, protoErr.msg)
+	}
+	m.conn.Close()
+	m.mu.Lock()
+	streams := m.streams
+	m.streams = make(map[uint32]*muxStream)
+	m.mu.Unlock()
+	for _, stream := range streams {
+		stream.fail(err)
+	}
+}
+
+func (m *muxSession) readLoop() error {
+	var hdr [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(m.ws, hdr[:]); err != nil {
+			return err
+		}
+		typ, id, n := hdr[0], binary.BigEndian.Uint32(hdr[1:5]), binary.BigEndian.Uint32(hdr[5:9])
+		if n > muxMaxPayload {
+			return &muxProtocolError{msg: fmt.Sprintf("frame of %d bytes", n)}
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(m.ws, payload); err != nil {
+			return err
+		}
+		if typ == muxOpen {
+			if err := m.open(id, payload); err != nil {
+				return err
+			}
+			continue
+		}
+		stream := m.stream(id)
+		if stream == nil {
+			// Frames may cross the close of their stream.
+			continue
+		}
+		switch typ {
+		case muxData:
+			if err := stream.push(payload); err != nil {
+				return err
+			}
+		case muxWindow:
+			if n != 4 {
+				return &muxProtocolError{msg: "bad window frame"}
+			}
+			stream.credit(int(binary.BigEndian.Uint32(payload)))
+		case muxClose:
+			if n < 2 {
+				return &muxProtocolError{msg: "bad close frame"}
+			}
+			stream.remoteClose(int(binary.BigEndian.Uint16(payload)), string(payload[2:]))
+		default:
+			return &muxProtocolError{msg: fmt.Sprintf("unknown frame type %d", typ)}
+		}
+	}
+}
+
+func (m *muxSession) open(id uint32, payload []byte) error {
+	m.mu.Lock()
+	if _, ok := m.streams[id]; ok || id == 0 {
+		m.mu.Unlock()
+		return &muxProtocolError{msg: fmt.Sprintf("stream %d reused", id)}
+	}
+	stream := &muxStream{sess: m, id: id, window: muxWindowSize}
+	stream.cond = sync.NewCond(&stream.mu)
+	full := len(m.streams) >= muxMaxStreams
+	if !full {
+		m.streams[id] = stream
+	}
+	m.mu.Unlock()
+	if full {
+		refused := &admitError{status: http.StatusTooManyRequests, code: ErrCodeTooManyTunnels, msg: "too many streams"}
+		if err := m.writeFrame(muxError, id, refused.message().marshal()); err != nil {
+			return err
+		}
+		return m.writeFrame(muxClose, id, closePayload(refusedCloseCode(refused.status), refused.msg))
+	}
+	go m.serveStream(stream, payload)
+	return nil
+}
+
+func (m *muxSession) serveStream(stream *muxStream, payload []byte) {
+	var req muxOpenRequest
+	err := json.Unmarshal(payload, &req)
+	host, port := strings.Trim(req.Host, "[]"), req.Port
+	if err != nil || len(req.Target) == 0 && (len(host) == 0 || port < 1 || port > 65535) {
+		m.s.metrics.tunnelFailed(failBadRequest)
+		stream.refuse(&admitError{status: http.StatusBadRequest, code: ErrCodeBadRequest, msg: "bad request"})
+		return
+	}
+	st := m.s.current()
+	var target *Target
+	if len(req.Target) != 0 {
+		var ok bool
+		if target, ok = st.Targets.Lookup(req.Target); !ok {
+			m.s.logger().Warn("unknown target", "target", req.Target, "client_ip", clientIP(m.r))
+			m.s.metrics.tunnelFailed(failBadRequest)
+			stream.refuse(errUnknownTarget)
+			return
+		}
+		host, port = target.Host, target.Port
+	}
+	user, release, refused := m.s.admit(m.r, st, host, port, target, req.Ticket)
+	if refused != nil {
+		stream.refuse(refused)
+		return
+	}
+	defer release()
+	if err := m.writeFrame(muxOpened, stream.id, nil); err != nil {
+		stream.Close()
+		return
+	}
+	t := newTunnel(m.r, st, host, port)
+	t.user = user
+	t.target = target
+	m.s.serveTunnel(m.s.ctx, stream, t)
+}
+
+func (m *muxSession) stream(id uint32) *muxStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[id]
+}
+
+func (m *muxSession) remove(id uint32) {
+	m.mu.Lock()
+	_, ok := m.streams[id]
+	delete(m.streams, id)
+	idle := ok && m.draining && len(m.streams) == 0
+	m.mu.Unlock()
+	if idle {
+		m.closeDrained()
+	}
+}
+
+// closeDrained ends a session without streams once the server drains.
+func (m *muxSession) closeDrained() {
+	writeClose(m.conn, CloseGoingAway, "server shutdown")
+	time.AfterFunc(closeGrace, func() { m.conn.Close() })
+}
+
+func (m *muxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[muxHeaderSize:], payload)
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	if _, err := m.ws.Write(frame); err != nil {
+		// The read loop notices and fails every stream.
+		m.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func closePayload(code int, reason string) []byte {
+	p := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	return append(p, reason...)
+}
+
+// muxStream is the browser end of a tunnel carried by a muxSession.
+type muxStream struct {
+	sess *muxSession
+	id   uint32
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// consumed is read but not yet returned as credit.
+	consumed int
+	// window is how much may still be sent.
+	window int
+	// err ends reads and writes once the stream is closed.
+	err       error
+	closeSent bool
+}
+
+func (ms *muxStream) push(p []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.err != nil {
+		return nil
+	}
+	if ms.buf.Len()+len(p) > muxWindowSize {
+		return &muxProtocolError{msg: fmt.Sprintf("stream %d overran its window", ms.id)}
+	}
+	ms.buf.Write(p)
+	ms.cond.Broadcast()
+	return nil
+}
+
+func (ms *muxStream) credit(n int) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.window += n
+	ms.cond.Broadcast()
+}
+
+// remoteClose ends the stream on the browser's close frame, reads return a
+// websocket.CloseError as they would for a plain tunnel.
+func (ms *muxStream) remoteClose(code int, reason string) {
+	ms.fail(&websocket.CloseError{Code: code, Text: reason})
+}
+
+func (ms *muxStream) fail(err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.err == nil {
+		ms.err = err
+	}
+	ms.cond.Broadcast()
+}
+
+func (ms *muxStream) refuse(refused *admitError) {
+	ms.sendControl(refused.message())
+	ms.sendClose(refusedCloseCode(refused.status), refused.msg)
+	ms.Close()
+}
+
+func (ms *muxStream) Read(p []byte) (int, error) {
+	ms.mu.Lock()
+	for ms.buf.Len() == 0 && ms.err == nil {
+		ms.cond.Wait()
+	}
+	if ms.buf.Len() == 0 {
+		err := ms.err
+		ms.mu.Unlock()
+		return 0, err
+	}
+	n, _ := ms.buf.Read(p)
+	ms.consumed += n
+	var credit int
+	if ms.consumed >= muxWindowSize/2 {
+		credit, ms.consumed = ms.consumed, 0
+	}
+	ms.mu.Unlock()
+	if credit != 0 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(credit))
+		ms.sess.writeFrame(muxWindow, ms.id, b[:])
+	}
+	return n, nil
+}
+
+func (ms *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) != 0 {
+		ms.mu.Lock()
+		for ms.window == 0 && ms.err == nil {
+			ms.cond.Wait()
+		}
+		if ms.err != nil {
+			err := ms.err
+			ms.mu.Unlock()
+			return written, err
+		}
+		n := min(len(p), ms.window, muxMaxPayload)
+		ms.window -= n
+		ms.mu.Unlock()
+		if err := ms.sess.writeFrame(muxData, ms.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// SetReadDeadline is a no-op like that of wsStream.
+func (ms *muxStream) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// keepalive returns at once, the session pings for all its streams.
+func (ms *muxStream) keepalive(<-chan struct{}) {}
+
+func (ms *muxStream) sendControl(msg ControlMessage) error {
+	return ms.sess.writeFrame(muxError, ms.id, msg.marshal())
+}
+
+func (ms *muxStream) sendClose(code int, reason string) error {
+	ms.mu.Lock()
+	sent := ms.closeSent
+	ms.closeSent = true
+	ms.mu.Unlock()
+	if sent {
+		return nil
+	}
+	if len(reason) > muxMaxPayload-2 {
+		reason = reason[:muxMaxPayload-2]
+	}
+	return ms.sess.writeFrame(muxClose, ms.id, closePayload(code, reason))
+}
+
+func (ms *muxStream) Close() error {
+	ms.fail(io.ErrClosedPipe)
+	ms.sess.remove(ms.id)
+	return nil
+}
@@ -0,0 +1,318 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// muxTestTarget listens on loopback and hands every connection to serve.
+func muxTestTarget(t *testing.T, serve func(net.Conn)) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// newTestServer serves the tunnel endpoints of a server that accepts any
+// origin and allows loopback targets on top of cfg. It returns the server
+// and the ws:// URL of its root.
+func newTestServer(t *testing.T, cfg *Config) (*WsToTcpServer, string) {
+	t.Helper()
+	cfg.Origins.AllowAny = true
+	cfg.Policy.Rules = append(cfg.Policy.Rules, RuleConfig{Action: PolicyAllow, CIDRs: []string{"127.0.0.0/8"}})
+	st, err := NewSettings(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s := NewWsToTcpServer(ctx, "", 0)
+	s.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	s.Apply(st)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/{server}/{port}", s.wsUpgradeHandler)
+	mux.HandleFunc("/ws/alias/{name}", s.wsAliasHandler)
+	mux.HandleFunc("/ws/mux", s.muxHandler)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return s, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// dialMuxTest opens a mux session to a server that allows loopback
+// targets.
+func dialMuxTest(t *testing.T) *websocket.Conn {
+	t.Helper()
+	_, url := newTestServer(t, &Config{})
+	return dialMux(t, url)
+}
+
+// dialMux opens a mux session to the server at url.
+func dialMux(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: []string{MuxProtocol}}
+	conn, _, err := dialer.Dial(url+"/ws/mux", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+type muxFrame struct {
+	typ     byte
+	id      uint32
+	payload []byte
+}
+
+func sendMuxFrame(t *testing.T, conn *websocket.Conn, typ byte, id uint32, payload []byte) {
+	t.Helper()
+	frame := []byte{typ}
+	frame = binary.BigEndian.AppendUint32(frame, id)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	if err := conn.WriteMessage(websocket.BinaryMessage, append(frame, payload...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readMuxFrame reads the next frame, every frame is sent as one message.
+func readMuxFrame(conn *websocket.Conn, timeout time.Duration) (muxFrame, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return muxFrame{}, err
+	}
+	if len(msg) < muxHeaderSize || int(binary.BigEndian.Uint32(msg[5:9])) != len(msg)-muxHeaderSize {
+		return muxFrame{}, errors.New("malformed frame")
+	}
+	return muxFrame{typ: msg[0], id: binary.BigEndian.Uint32(msg[1:5]), payload: msg[muxHeaderSize:]}, nil
+}
+
+func openMuxStream(t *testing.T, conn *websocket.Conn, id uint32, port int) {
+	t.Helper()
+	req, _ := json.Marshal(muxOpenRequest{Host: "127.0.0.1", Port: port})
+	sendMuxFrame(t, conn, muxOpen, id, req)
+	f, err := readMuxFrame(conn, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.typ != muxOpened || f.id != id {
+		t.Fatalf("open answered with frame %d for stream %d: %q", f.typ, f.id, f.payload)
+	}
+}
+
+func TestMuxEcho(t *testing.T) {
+	port := muxTestTarget(t, func(c net.Conn) { io.Copy(c, c) })
+	conn := dialMuxTest(t)
+	openMuxStream(t, conn, 1, port)
+	openMuxStream(t, conn, 2, port)
+	sendMuxFrame(t, conn, muxData, 2, []byte("two"))
+	sendMuxFrame(t, conn, muxData, 1, []byte("one"))
+	got := map[uint32]string{}
+	for len(got) < 2 {
+		f, err := readMuxFrame(conn, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.typ == muxData {
+			got[f.id] += string(f.payload)
+		}
+	}
+	if got[1] != "one" || got[2] != "two" {
+		t.Errorf("echoed %q", got)
+	}
+
+	sendMuxFrame(t, conn, muxClose, 1, closePayload(websocket.CloseNormalClosure, ""))
+	for {
+		f, err := readMuxFrame(conn, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.typ == muxClose && f.id == 1 {
+			break
+		}
+	}
+	// The session and its other streams outlive the closed one.
+	sendMuxFrame(t, conn, muxData, 2, []byte("still"))
+	if f, err := readMuxFrame(conn, 5*time.Second); err != nil || f.typ != muxData || string(f.payload) != "still" {
+		t.Errorf("after closing stream 1 read %+v, %v", f, err)
+	}
+}
+
+// readMuxData reads data frames of stream id until n bytes arrived.
+func readMuxData(t *testing.T, conn *websocket.Conn, id uint32, n int) {
+	t.Helper()
+	for received := 0; received < n; {
+		f, err := readMuxFrame(conn, 5*time.Second)
+		if err != nil {
+			t.Fatalf("after %d of %d bytes: %v", received, n, err)
+		}
+		if f.typ == muxData && f.id == id {
+			if len(f.payload) > muxMaxPayload {
+				t.Fatalf("data frame of %d bytes", len(f.payload))
+			}
+			received += len(f.payload)
+		}
+	}
+}
+
+func TestMuxWindow(t *testing.T) {
+	const extra = 1000
+	port := muxTestTarget(t, func(c net.Conn) {
+		c.Write(make([]byte, muxWindowSize+extra))
+		io.Copy(io.Discard, c)
+	})
+	conn := dialMuxTest(t)
+	openMuxStream(t, conn, 1, port)
+
+	// Without credit the server sends one window of data and stops.
+	readMuxData(t, conn, 1, muxWindowSize)
+	if f, err := readMuxFrame(conn, 300*time.Millisecond); err == nil {
+		t.Fatalf("frame %d with %d bytes past the window", f.typ, len(f.payload))
+	}
+	// The timed out read broke the connection, credit goes over a new one.
+	conn = dialMuxTest(t)
+	openMuxStream(t, conn, 1, port)
+	readMuxData(t, conn, 1, muxWindowSize)
+	sendMuxFrame(t, conn, muxWindow, 1, binary.BigEndian.AppendUint32(nil, extra))
+	readMuxData(t, conn, 1, extra)
+}
+
+func TestMuxReturnsCredit(t *testing.T) {
+	port := muxTestTarget(t, func(c net.Conn) { io.Copy(io.Discard, c) })
+	conn := dialMuxTest(t)
+	openMuxStream(t, conn, 1, port)
+	for sent := 0; sent < muxWindowSize/2; sent += muxMaxPayload {
+		sendMuxFrame(t, conn, muxData, 1, make([]byte, muxMaxPayload))
+	}
+	for {
+		f, err := readMuxFrame(conn, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.typ == muxWindow {
+			if f.id != 1 || len(f.payload) != 4 || binary.BigEndian.Uint32(f.payload) < muxWindowSize/2 {
+				t.Errorf("window frame for stream %d: %x", f.id, f.payload)
+			}
+			return
+		}
+	}
+}
+
+func TestMuxProtocolErrors(t *testing.T) {
+	port := muxTestTarget(t, func(c net.Conn) { io.Copy(io.Discard, c) })
+	header := func(typ byte, id, n uint32) []byte {
+		h := binary.BigEndian.AppendUint32([]byte{typ}, id)
+		return binary.BigEndian.AppendUint32(h, n)
+	}
+	open, _ := json.Marshal(muxOpenRequest{Host: "127.0.0.1", Port: port})
+	tests := []struct {
+		name   string
+		opened bool // stream 1 is opened first
+		frame  []byte
+	}{
+		{"oversized frame", false, header(muxData, 1, muxMaxPayload+1)},
+		{"stream 0", false, append(header(muxOpen, 0, uint32(len(open))), open...)},
+		{"reused stream", true, append(header(muxOpen, 1, uint32(len(open))), open...)},
+		{"unknown type", true, header(9, 1, 0)},
+		{"short window", true, append(header(muxWindow, 1, 2), 0, 1)},
+		{"short close", true, append(header(muxClose, 1, 1), 3)},
+	}
+	for _, tt := range tests {
+		conn := dialMuxTest(t)
+		if tt.opened {
+			openMuxStream(t, conn, 1, port)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, tt.frame); err != nil {
+			t.Fatal(err)
+		}
+		var closeErr *websocket.CloseError
+		for {
+			_, err := readMuxFrame(conn, 5*time.Second)
+			if errors.As(err, &closeErr) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if closeErr.Code != websocket.CloseProtocolError {
+			t.Errorf("%s: session closed with %d, want %d", tt.name, closeErr.Code, websocket.CloseProtocolError)
+		}
+	}
+}
+
+func TestMuxRefusesBadOpen(t *testing.T) {
+	conn := dialMuxTest(t)
+	for _, payload := range []string{`{}`, `{"host":"127.0.0.1","port":0}`, `not json`} {
+		sendMuxFrame(t, conn, muxOpen, 7, []byte(payload))
+		var gotError bool
+		for {
+			f, err := readMuxFrame(conn, 5*time.Second)
+			if err != nil {
+				t.Fatalf("%s: %v", payload, err)
+			}
+			if f.id != 7 {
+				continue
+			}
+			if f.typ == muxError {
+				gotError = true
+			}
+			if f.typ == muxClose {
+				if code := binary.BigEndian.Uint16(f.payload); code != 4400 {
+					t.Errorf("%s: closed with %d, want 4400", payload, code)
+				}
+				break
+			}
+		}
+		if !gotError {
+			t.Errorf("%s: no error frame before the close", payload)
+		}
+	}
+}
+
+func TestMuxStreamPushOverrun(t *testing.T) {
+	ms := &muxStream{id: 1}
+	ms.cond = sync.NewCond(&ms.mu)
+	if err := ms.push(make([]byte, muxWindowSize)); err != nil {
+		t.Fatalf("push of one window: %v", err)
+	}
+	var protoErr *muxProtocolError
+	if err := ms.push([]byte{0}); !errors.As(err, &protoErr) {
+		t.Errorf("push past the window = %v, want a protocol error", err)
+	}
+	ms.fail(io.ErrClosedPipe)
+	if err := ms.push(make([]byte, muxWindowSize)); err != nil {
+		t.Errorf("push to a closed stream = %v, want it dropped", err)
+	}
+}
@@ -0,0 +1,143 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// DefaultOrigins are the origins accepted when nothing else is configured.
+var DefaultOrigins = []string{"localhost", "wrtx.dev", "www.wrtx.dev"}
+
+var defaultOriginPolicy = mustOriginPolicy(DefaultOrigins)
+
+// OriginPolicy decides which browser origins may open a tunnel.
+//
+// A pattern is one of:
+//
+//	example.com              exact host, any scheme and port
+//	*.example.com            any subdomain of example.com (not example.com itself)
+//	https://example.com      scheme and host, default port of the scheme
+//	https://example.com:8443 scheme, host and port
+//	*                        any host
+type OriginPolicy struct {
+	// AllowAny accepts every request, including ones without an Origin
+	// header. Only meant for local development.
+	AllowAny bool
+	rules    []originRule
+}
+
+type originRule struct {
+	scheme string // empty matches any scheme
+	host   string // lower case, "*." prefix matches subdomains, "*" matches all
+	port   string // empty matches any port
+}
+
+// NewOriginPolicy compiles the given patterns into an OriginPolicy.
+func NewOriginPolicy(patterns []string, allowAny bool) (*OriginPolicy, error) {
+	p := &OriginPolicy{AllowAny: allowAny}
+	for _, pattern := range patterns {
+		rule, err := parseOriginPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("origin pattern %q: %w", pattern, err)
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+func mustOriginPolicy(patterns []string) *OriginPolicy {
+	p, err := NewOriginPolicy(patterns, false)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func parseOriginPattern(pattern string) (originRule, error) {
+	pattern = strings.TrimSpace(strings.ToLower(pattern))
+	if pattern == "" {
+		return originRule{}, errors.New("empty pattern")
+	}
+	var rule originRule
+	hostport := pattern
+	if strings.Contains(pattern, "://") {
+		u, err := url.Parse(pattern)
+		if err != nil {
+			return originRule{}, err
+		}
+		if u.Path != "" && u.Path != "/" {
+			return originRule{}, errors.New("origin must not contain a path")
+		}
+		rule.scheme = u.Scheme
+		hostport = u.Host
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = strings.Trim(hostport, "[]"), ""
+	}
+	if host == "" {
+		return originRule{}, errors.New("missing host")
+	}
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") && host != "*" {
+		return originRule{}, errors.New("wildcard is only allowed as the leading label")
+	}
+	if port == "" && rule.scheme != "" {
+		port = defaultPort(rule.scheme)
+	}
+	rule.host, rule.port = host, port
+	return rule, nil
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "http", "ws":
+		return "80"
+	case "https", "wss":
+		return "443"
+	}
+	return ""
+}
+
+func (r originRule) match(scheme, host, port string) bool {
+	if r.scheme != "" && r.scheme != scheme {
+		return false
+	}
+	if r.port != "" && r.port != port {
+		return false
+	}
+	switch {
+	case r.host == "*":
+		return true
+	case strings.HasPrefix(r.host, "*."):
+		return strings.HasSuffix(host, r.host[1:])
+	default:
+		return r.host == host
+	}
+}
+
+// Check returns nil when origin is allowed, otherwise an error describing why
+// it was rejected.
+func (p *OriginPolicy) Check(origin string) error {
+	if p.AllowAny {
+		return nil
+	}
+	if len(origin) == 0 {
+		return errors.New("missing Origin header")
+	}
+	scheme, host, port, err := parseOrigin(origin)
+	if err != nil {
+		return fmt.Errorf("malformed Origin %q: %w", origin, err)
+	}
+	for _, rule := range p.rules {
+		if rule.match(scheme, host, port) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %q is not in the allowlist", origin)
+}
@@ -0,0 +1,74 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import "testing"
+
+func TestOriginPolicyCheck(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		origin   string
+		ok       bool
+	}{
+		{[]string{"example.com"}, "https://example.com", true},
+		{[]string{"example.com"}, "http://example.com:8080", true},
+		{[]string{"example.com"}, "HTTPS://Example.COM", true},
+		{[]string{"example.com"}, "https://evil.com", false},
+		{[]string{"example.com"}, "https://example.com.evil.com", false},
+		{[]string{"example.com"}, "https://sub.example.com", false},
+		{[]string{"*.example.com"}, "https://a.example.com", true},
+		{[]string{"*.example.com"}, "https://a.b.example.com", true},
+		{[]string{"*.example.com"}, "https://example.com", false},
+		{[]string{"*.example.com"}, "https://badexample.com", false},
+		{[]string{"https://example.com"}, "https://example.com", true},
+		{[]string{"https://example.com"}, "https://example.com:443", true},
+		{[]string{"https://example.com"}, "http://example.com", false},
+		{[]string{"https://example.com"}, "https://example.com:8443", false},
+		{[]string{"https://example.com:8443"}, "https://example.com:8443", true},
+		{[]string{"https://example.com:8443"}, "https://example.com", false},
+		{[]string{"[::1]"}, "http://[::1]:8080", true},
+		{[]string{"*"}, "https://anything.test", true},
+		{[]string{"example.com"}, "", false},
+		{[]string{"example.com"}, "null", false},
+		{[]string{"example.com"}, "example.com", false},
+		{nil, "https://example.com", false},
+	}
+	for _, tt := range tests {
+		p, err := NewOriginPolicy(tt.patterns, false)
+		if err != nil {
+			t.Fatalf("NewOriginPolicy(%q): %v", tt.patterns, err)
+		}
+		if err := p.Check(tt.origin); (err == nil) != tt.ok {
+			t.Errorf("%q: Check(%q) = %v, want ok %v", tt.patterns, tt.origin, err, tt.ok)
+		}
+	}
+}
+
+func TestOriginPolicyAllowAny(t *testing.T) {
+	p, err := NewOriginPolicy(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, origin := range []string{"", "null", "https://evil.com"} {
+		if err := p.Check(origin); err != nil {
+			t.Errorf("Check(%q) = %v, want nil", origin, err)
+		}
+	}
+}
+
+func TestParseOriginPatternErrors(t *testing.T) {
+	for _, pattern := range []string{
+		"",
+		"   ",
+		"https://example.com/path",
+		"a.*.example.com",
+		"*.*.example.com",
+		"example*.com",
+		"https://:443",
+	} {
+		if _, err := parseOriginPattern(pattern); err == nil {
+			t.Errorf("parseOriginPattern(%q) succeeded, want an error", pattern)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+
+	// ProtocolAny relays whatever the target speaks, ProtocolSSH requires
+	// both sides to open with an SSH identification line.
+	ProtocolAny = "any"
+	ProtocolSSH = "ssh"
+)
+
+// PolicyConfig describes which destinations the proxy may dial. Rules are
+// evaluated in order and the first matching rule wins; Default applies when
+// no rule matches.
+type PolicyConfig struct {
+	// Default is "allow" (the default) or "deny".
+	Default string `yaml:"default"`
+	// Via names the upstream proxy destinations are dialed through unless
+	// their rule names another, see UpstreamConfig. Empty or "direct"
+	// dials directly.
+	Via string `yaml:"via"`
+	// Protocol is "any" (the default) or "ssh", which closes tunnels whose
+	// target or browser does not speak SSH, unless their rule sets its own.
+	Protocol string `yaml:"protocol"`
+	// ProxyProtocol is "v1" or "v2" to start every target connection with
+	// a PROXY protocol header carrying the browser's address, for targets
+	// behind e.g. HAProxy or sshd with a PROXY aware front. Empty or "none"
+	// sends none.
+	ProxyProtocol string       `yaml:"proxy_protocol"`
+	Rules         []RuleConfig `yaml:"rules"`
+}
+
+// RuleConfig is a single destination rule. A rule without CIDRs and Hosts
+// matches every destination, a rule without Ports matches every port.
+type RuleConfig struct {
+	Action string `yaml:"action"`
+	// CIDRs match destinations given as IP addresses, e.g. 10.20.0.0/16.
+	// A hostname never matches them, its rule is found by Hosts alone, but
+	// the addresses it resolves to are checked against the CIDR rules when
+	// dialing: a matching deny rule refuses them. Loopback, private and
+	// other special ranges can only be reached through a CIDR allow rule.
+	CIDRs []string `yaml:"cidrs"`
+	// Hosts are hostname globs, e.g. *.corp.example.com.
+	Hosts []string `yaml:"hosts"`
+	// Ports are single ports or ranges, e.g. "22" or "2200-2299".
+	Ports []string `yaml:"ports"`
+	// Via overrides PolicyConfig.Via for destinations this rule allows.
+	Via string `yaml:"via"`
+	// Protocol overrides PolicyConfig.Protocol for destinations this rule
+	// allows.
+	Protocol string `yaml:"protocol"`
+	// ProxyProtocol overrides PolicyConfig.ProxyProtocol for destinations
+	// this rule allows.
+	ProxyProtocol string `yaml:"proxy_protocol"`
+	Comment       string `yaml:"comment"`
+}
+
+// Policy is a compiled PolicyConfig.
+type Policy struct {
+	defaultAllow  bool
+	via           string
+	requireSSH    bool
+	proxyProtocol string
+	rules         []*policyRule
+}
+
+type policyRule struct {
+	index int
+	allow bool
+	nets  []netip.Prefix
+	hosts []string
+	ports []portRange
+	via   string
+	// protocol and proxyProtocol are empty when the policy's applies.
+	protocol      string
+	proxyProtocol string
+	comment       string
+}
+
+type portRange struct {
+	lo, hi int
+}
+
+// Decision is the result of evaluating a destination against a Policy.
+type Decision struct {
+	Allow bool
+	// Via is the upstream to dial through, empty for a direct dial.
+	Via string
+	// RequireSSH closes the tunnel unless both sides speak SSH.
+	RequireSSH bool
+	// ProxyProtocol is the PROXY protocol version to announce the browser
+	// to the target with, empty for none.
+	ProxyProtocol string
+	// rule is nil when the policy default was applied.
+	rule *policyRule
+}
+
+// Explicit reports whether a rule, not the policy default, decided.
+func (d Decision) Explicit() bool {
+	return d.rule != nil
+}
+
+func (d Decision) String() string {
+	action := PolicyDeny
+	if d.Allow {
+		action = PolicyAllow
+	}
+	if d.rule == nil {
+		return action + " by default"
+	}
+	s := fmt.Sprintf("%s by rule #%d", action, d.rule.index)
+	if len(d.rule.comment) != 0 {
+		s += fmt.Sprintf(" (%s)", d.rule.comment)
+	}
+	return s
+}
+
+var defaultPolicy = &Policy{defaultAllow: true}
+
+// NewPolicy compiles cfg, reporting the first invalid entry.
+func NewPolicy(cfg PolicyConfig) (*Policy, error) {
+	p := &Policy{via: strings.TrimSpace(cfg.Via)}
+	protocol, err := parseProtocol(cfg.Protocol)
+	if err != nil {
+		return nil, fmt.Errorf("policy.protocol: %w", err)
+	}
+	p.requireSSH = protocol == ProtocolSSH
+	if p.proxyProtocol, err = parseProxyProtocol(cfg.ProxyProtocol); err != nil {
+		return nil, fmt.Errorf("policy.proxy_protocol: %w", err)
+	}
+	switch strings.ToLower(cfg.Default) {
+	case "", PolicyAllow:
+		p.defaultAllow = true
+	case PolicyDeny:
+	default:
+		return nil, fmt.Errorf("policy.default: unknown action %q", cfg.Default)
+	}
+	for i, rc := range cfg.Rules {
+		rule, err := compileRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("policy.rules[%d]: %w", i, err)
+		}
+		rule.index = i
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+func compileRule(rc RuleConfig) (*policyRule, error) {
+	rule := &policyRule{via: strings.TrimSpace(rc.Via), comment: rc.Comment}
+	switch strings.ToLower(rc.Action) {
+	case PolicyAllow:
+		rule.allow = true
+	case PolicyDeny:
+	default:
+		return nil, fmt.Errorf("action: unknown action %q", rc.Action)
+	}
+	if len(rc.Protocol) != 0 {
+		var err error
+		if rule.protocol, err = parseProtocol(rc.Protocol); err != nil {
+			return nil, fmt.Errorf("protocol: %w", err)
+		}
+	}
+	if len(rc.ProxyProtocol) != 0 {
+		version, err := parseProxyProtocol(rc.ProxyProtocol)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_protocol: %w", err)
+		}
+		if len(version) == 0 {
+			// none must still override a version of the policy.
+			version = ProxyProtocolNone
+		}
+		rule.proxyProtocol = version
+	}
+	for _, c := range rc.CIDRs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(c)
+			if aerr != nil {
+				return nil, fmt.Errorf("cidrs: %w", err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		rule.nets = append(rule.nets, prefix.Masked())
+	}
+	for _, h := range rc.Hosts {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if _, err := path.Match(h, ""); err != nil {
+			return nil, fmt.Errorf("hosts: bad pattern %q", h)
+		}
+		rule.hosts = append(rule.hosts, h)
+	}
+	for _, ps := range rc.Ports {
+		pr, err := parsePortRange(ps)
+		if err != nil {
+			return nil, fmt.Errorf("ports: %w", err)
+		}
+		rule.ports = append(rule.ports, pr)
+	}
+	return rule, nil
+}
+
+// parseProtocol returns the protocol s names, ProtocolAny when it is empty.
+func parseProtocol(s string) (string, error) {
+	switch p := strings.ToLower(strings.TrimSpace(s)); p {
+	case "", ProtocolAny:
+		return ProtocolAny, nil
+	case ProtocolSSH:
+		return p, nil
+	}
+	return "", fmt.Errorf("want %q or %q, got %q", ProtocolAny, ProtocolSSH, s)
+}
+
+func parsePortRange(s string) (portRange, error) {
+	lo, hi, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	l, err := strconv.Atoi(lo)
+	if err != nil {
+		return portRange{}, fmt.Errorf("bad port %q", s)
+	}
+	h := l
+	if isRange {
+		if h, err = strconv.Atoi(hi); err != nil {
+			return portRange{}, fmt.Errorf("bad port range %q", s)
+		}
+	}
+	if l < 1 || h > 65535 || l > h {
+		return portRange{}, fmt.Errorf("port range %q out of bounds", s)
+	}
+	return portRange{lo: l, hi: h}, nil
+}
+
+func (r *policyRule) matchPort(port int) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, pr := range r.ports {
+		if port >= pr.lo && port <= pr.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *policyRule) matchHost(host string) bool {
+	if len(r.nets) == 0 && len(r.hosts) == 0 {
+		return true
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		for _, n := range r.nets {
+			if n.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range r.hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate decides whether host:port may be dialed. host is either a
+// hostname or an IP address literal.
+func (p *Policy) Evaluate(host string, port int) Decision {
+	for _, rule := range p.rules {
+		if rule.matchPort(port) && rule.matchHost(host) {
+			return Decision{Allow: rule.allow, Via: p.upstream(rule), RequireSSH: p.sshRequired(rule),
+				ProxyProtocol: p.proxyHeader(rule), rule: rule}
+		}
+	}
+	return Decision{Allow: p.defaultAllow, Via: p.upstream(nil), RequireSSH: p.requireSSH, ProxyProtocol: p.proxyProtocol}
+}
+
+// proxyHeader returns the PROXY protocol version for destinations rule
+// allows, empty for none.
+func (p *Policy) proxyHeader(rule *policyRule) string {
+	switch rule.proxyProtocol {
+	case "":
+		return p.proxyProtocol
+	case ProxyProtocolNone:
+		return ""
+	}
+	return rule.proxyProtocol
+}
+
+// sshRequired reports whether destinations rule allows must speak SSH.
+func (p *Policy) sshRequired(rule *policyRule) bool {
+	if len(rule.protocol) == 0 {
+		return p.requireSSH
+	}
+	return rule.protocol == ProtocolSSH
+}
+
+// upstream returns the upstream named by rule, or the policy wide one.
+func (p *Policy) upstream(rule *policyRule) string {
+	via := p.via
+	if rule != nil && len(rule.via) != 0 {
+		via = rule.via
+	}
+	if via == directUpstream {
+		return ""
+	}
+	return via
+}
+
+// upstreams lists every upstream name the policy refers to.
+func (p *Policy) upstreams() []string {
+	vias := []string{p.via}
+	for _, rule := range p.rules {
+		vias = append(vias, rule.via)
+	}
+	var names []string
+	for _, via := range vias {
+		if len(via) != 0 && via != directUpstream {
+			names = append(names, via)
+		}
+	}
+	return names
+}
+
+// hasCIDRRules reports whether any rule lists CIDRs, which only resolved
+// addresses can be checked against.
+func (p *Policy) hasCIDRRules() bool {
+	for _, rule := range p.rules {
+		if len(rule.nets) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateAddr decides a resolved address using only rules that list CIDRs.
+// ok is false when no such rule matches.
+func (p *Policy) evaluateAddr(addr netip.Addr, port int) (d Decision, ok bool) {
+	for _, rule := range p.rules {
+		if len(rule.nets) == 0 || !rule.matchPort(port) {
+			continue
+		}
+		for _, n := range rule.nets {
+			if n.Contains(addr) {
+				return Decision{Allow: rule.allow, rule: rule}, true
+			}
+		}
+	}
+	return Decision{}, false
+}
@@ -0,0 +1,138 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPolicyEvaluate(t *testing.T) {
+	p, err := NewPolicy(PolicyConfig{
+		Default: "deny",
+		Rules: []RuleConfig{
+			{Action: "deny", CIDRs: []string{"10.20.0.99"}},
+			{Action: "allow", CIDRs: []string{"10.20.0.0/16"}, Ports: []string{"22"}},
+			{Action: "allow", Hosts: []string{"*.corp.example.com"}, Ports: []string{"22", "2200-2299"}},
+			{Action: "deny", Hosts: []string{"secret.example.com"}},
+			{Action: "allow", Hosts: []string{"*.example.com"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host  string
+		port  int
+		allow bool
+		rule  int // -1 for the default
+	}{
+		{"10.20.0.5", 22, true, 1},
+		{"10.20.0.5", 23, false, -1},
+		{"10.20.0.99", 22, false, 0},
+		{"::ffff:10.20.0.5", 22, true, 1},
+		{"10.21.0.5", 22, false, -1},
+		{"jump.corp.example.com", 22, true, 2},
+		{"JUMP.corp.example.com.", 2250, true, 2},
+		{"jump.corp.example.com", 2300, true, 4},
+		{"secret.example.com", 22, false, 3},
+		{"www.example.com", 443, true, 4},
+		{"example.com", 22, false, -1},
+		{"example.org", 22, false, -1},
+	}
+	for _, tt := range tests {
+		d := p.Evaluate(tt.host, tt.port)
+		if d.Allow != tt.allow {
+			t.Errorf("Evaluate(%q, %d).Allow = %v, want %v (%s)", tt.host, tt.port, d.Allow, tt.allow, d)
+		}
+		rule := -1
+		if d.Explicit() {
+			rule = d.rule.index
+		}
+		if rule != tt.rule {
+			t.Errorf("Evaluate(%q, %d) decided by rule %d, want %d", tt.host, tt.port, rule, tt.rule)
+		}
+	}
+}
+
+func TestPolicyEvaluateSettings(t *testing.T) {
+	p, err := NewPolicy(PolicyConfig{
+		Via:           "egress",
+		Protocol:      "ssh",
+		ProxyProtocol: "v2",
+		Rules: []RuleConfig{
+			{Action: "allow", Hosts: []string{"direct.test"}, Via: "direct", Protocol: "any", ProxyProtocol: "none"},
+			{Action: "allow", Hosts: []string{"other.test"}, Via: "other", ProxyProtocol: "v1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host          string
+		via           string
+		requireSSH    bool
+		proxyProtocol string
+	}{
+		{"direct.test", "", false, ""},
+		{"other.test", "other", true, "v1"},
+		{"default.test", "egress", true, "v2"},
+	}
+	for _, tt := range tests {
+		d := p.Evaluate(tt.host, 22)
+		if d.Via != tt.via || d.RequireSSH != tt.requireSSH || d.ProxyProtocol != tt.proxyProtocol {
+			t.Errorf("Evaluate(%q) = via %q, ssh %v, proxy %q, want %q, %v, %q",
+				tt.host, d.Via, d.RequireSSH, d.ProxyProtocol, tt.via, tt.requireSSH, tt.proxyProtocol)
+		}
+	}
+}
+
+func TestPolicyEvaluateAddr(t *testing.T) {
+	p, err := NewPolicy(PolicyConfig{Rules: []RuleConfig{
+		{Action: "allow", Hosts: []string{"*"}},
+		{Action: "deny", CIDRs: []string{"192.168.1.0/24"}, Ports: []string{"22"}},
+		{Action: "allow", CIDRs: []string{"192.168.0.0/16"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr  string
+		port  int
+		allow bool
+		ok    bool
+	}{
+		{"192.168.1.5", 22, false, true},
+		{"192.168.1.5", 80, true, true},
+		{"192.168.2.5", 22, true, true},
+		{"10.0.0.1", 22, false, false},
+	}
+	for _, tt := range tests {
+		d, ok := p.evaluateAddr(netip.MustParseAddr(tt.addr), tt.port)
+		if ok != tt.ok || d.Allow != tt.allow {
+			t.Errorf("evaluateAddr(%s, %d) = %v, %v, want %v, %v", tt.addr, tt.port, d.Allow, ok, tt.allow, tt.ok)
+		}
+	}
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	for _, cfg := range []PolicyConfig{
+		{Default: "maybe"},
+		{Protocol: "http"},
+		{ProxyProtocol: "v3"},
+		{Rules: []RuleConfig{{Action: "permit"}}},
+		{Rules: []RuleConfig{{Action: "allow", CIDRs: []string{"10.0.0.0/33"}}}},
+		{Rules: []RuleConfig{{Action: "allow", CIDRs: []string{"example.com"}}}},
+		{Rules: []RuleConfig{{Action: "allow", Hosts: []string{"[a-"}}}},
+		{Rules: []RuleConfig{{Action: "allow", Ports: []string{"0"}}}},
+		{Rules: []RuleConfig{{Action: "allow", Ports: []string{"65536"}}}},
+		{Rules: []RuleConfig{{Action: "allow", Ports: []string{"30-20"}}}},
+		{Rules: []RuleConfig{{Action: "allow", Ports: []string{"22-x"}}}},
+		{Rules: []RuleConfig{{Action: "allow", Protocol: "telnet"}}},
+	} {
+		if _, err := NewPolicy(cfg); err == nil {
+			t.Errorf("NewPolicy(%+v) succeeded, want an error", cfg)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol versions, see
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	ProxyProtocolNone = "none"
+	ProxyProtocolV1   = "v1"
+	ProxyProtocolV2   = "v2"
+
+	// proxyHeaderTimeout bounds how long a trusted proxy may take to send
+	// its PROXY header.
+	proxyHeaderTimeout = 5 * time.Second
+	// maxProxyV1Header is the longest v1 header, CR LF included.
+	maxProxyV1Header = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errBadProxyHeader = errors.New("bad PROXY header")
+
+// parseProxyProtocol returns the version s names, "" for none.
+func parseProxyProtocol(s string) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(s)); v {
+	case "", ProxyProtocolNone:
+		return "", nil
+	case ProxyProtocolV1, ProxyProtocolV2:
+		return v, nil
+	}
+	return "", fmt.Errorf("want %q, %q or %q, got %q", ProxyProtocolV1, ProxyProtocolV2, ProxyProtocolNone, s)
+}
+
+// proxyHeader returns the PROXY header of version that announces a
+// connection from src to dst. An invalid src is sent as an unknown
+// connection, the target then uses the proxy's own address.
+func proxyHeader(version string, src, dst netip.AddrPort) []byte {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	known := src.IsValid()
+	if known && !dst.IsValid() {
+		dst = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+		if src.Addr().Is6() {
+			dst = netip.AddrPortFrom(netip.IPv6Unspecified(), 0)
+		}
+	}
+	// Both addresses must be of one family, IPv4 is mapped into IPv6 if
+	// they differ.
+	if known && src.Addr().Is4() != dst.Addr().Is4() {
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+
+	if version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if src.Addr().Is6() {
+			family = "TCP6"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+	}
+
+	header := append([]byte(nil), proxyV2Signature...)
+	if !known {
+		// LOCAL command, unspecified family.
+		return append(header, 0x20, 0x00, 0, 0)
+	}
+	var addrs []byte
+	family := byte(0x11) // TCP over IPv4
+	if src.Addr().Is4() {
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	} else {
+		family = 0x21 // TCP over IPv6
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// writeProxyHeader announces t's browser to the target behind conn.
+func writeProxyHeader(conn net.Conn, version string, t *tunnel) error {
+	var dst netip.AddrPort
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		dst = addr.AddrPort()
+	}
+	if !dst.IsValid() && t.clientAddr.IsValid() {
+		// The upstream resolved the target, only its port is known.
+		unspecified := netip.IPv4Unspecified()
+		if t.clientAddr.Addr().Unmap().Is6() {
+			unspecified = netip.IPv6Unspecified()
+		}
+		dst = netip.AddrPortFrom(unspecified, uint16(t.port))
+	}
+	_, err := conn.Write(proxyHeader(version, t.clientAddr, dst))
+	return err
+}
+
+// TrustedProxies are the load balancers and reverse proxies in front of
+// the server whose PROXY headers and X-Forwarded-For headers are believed.
+type TrustedProxies struct {
+	nets []netip.Prefix
+	// unix trusts every peer on a Unix socket.
+	unix bool
+}
+
+// NewTrustedProxies compiles the trusted_proxies section, CIDRs, single
+// addresses or "unix". It returns nil when nothing is trusted.
+func NewTrustedProxies(entries []string) (*TrustedProxies, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	tp := &TrustedProxies{}
+	for i, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "unix" {
+			tp.unix = true
+			continue
+		}
+		prefix, err := netip.ParsePrefix(e)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(e)
+			if aerr != nil {
+				return nil, fmt.Errorf("trusted_proxies[%d]: %w", i, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		tp.nets = append(tp.nets, prefix.Masked())
+	}
+	return tp, nil
+}
+
+// trusts reports whether the peer at addr is a trusted proxy.
+func (tp *TrustedProxies) trusts(addr net.Addr) bool {
+	if tp == nil {
+		return false
+	}
+	switch a := addr.(type) {
+	case *net.UnixAddr:
+		return tp.unix
+	case *net.TCPAddr:
+		return tp.trustsIP(a.AddrPort().Addr())
+	}
+	return false
+}
+
+func (tp *TrustedProxies) trustsIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, n := range tp.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the client a trusted proxy forwarded r for: the
+// rightmost X-Forwarded-For entry that is not a trusted proxy itself, or
+// the leftmost when all are. An entry the walk reaches that is not an
+// address yields none rather than the trusted proxy behind it.
+func (tp *TrustedProxies) forwardedFor(r *http.Request) (netip.Addr, bool) {
+	if tp == nil {
+		return netip.Addr{}, false
+	}
+	if ip, err := netip.ParseAddr(clientIP(r)); err == nil {
+		if !tp.trustsIP(ip) {
+			return netip.Addr{}, false
+		}
+	} else if !tp.unix || !unixPeer(r.RemoteAddr) {
+		return netip.Addr{}, false
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.Trim(strings.TrimSpace(hops[i]), "[]"))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		client = ip.Unmap()
+		if !tp.trustsIP(client) {
+			return client, true
+		}
+	}
+	return client, client.IsValid()
+}
+
+// unixPeer reports whether remoteAddr is the address of a Unix socket
+// peer, a path or, for unnamed sockets, empty or "@".
+func unixPeer(remoteAddr string) bool {
+	return remoteAddr == "" || remoteAddr == "@" || strings.HasPrefix(remoteAddr, "/")
+}
+
+// forwarded makes r.RemoteAddr the address of the client when r comes
+// from a trusted proxy, so clientIP and everything using it see the client.
+func (s *WsToTcpServer) forwarded(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip, ok := s.current().TrustedProxies.forwardedFor(r); ok {
+			r = r.WithContext(r.Context())
+			r.RemoteAddr = netip.AddrPortFrom(ip, 0).String()
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// proxyListener accepts PROXY headers from trusted proxies, their
+// connections report the client as remote address.
+type proxyListener struct {
+	net.Listener
+	s *WsToTcpServer
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.s.current().TrustedProxies.trusts(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	// The header is read on first use, in the goroutine serving the
+	// connection rather than the accept loop.
+	return &proxyConn{Conn: conn, r: bufio.NewReader(conn), s: l.s}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	s      *WsToTcpServer
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		// Peers that hang up or stay silent, e.g. health checks, are not
+		// worth a warning.
+		if errors.Is(c.err, errBadProxyHeader) {
+			c.s.logger().Warn("rejected connection", "peer", c.Conn.RemoteAddr().String(), "error", c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY header of either version if r starts with
+// one and returns the client it announces, nil when it announces none.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil && len(start) == 0 {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(start, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r)
+	}
+	// A trusted proxy may also connect without a header, e.g. for health
+	// checks.
+	return nil, nil
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1Header {
+			return nil, fmt.Errorf("%w: v1 header too long", errBadProxyHeader)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header %q", errBadProxyHeader, strings.TrimSpace(string(line)))
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadProxyHeader, err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad v1 port %q", errBadProxyHeader, fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", errBadProxyHeader, hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0x0f == 0 {
+		// LOCAL, the proxy speaks for itself.
+		return nil, nil
+	}
+	var ip netip.Addr
+	var port []byte
+	switch hdr[13] {
+	case 0x11:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short v2 address block", errBadProxyHeader)
+		}
+		ip, port = netip.AddrFrom4([4]byte(body[0:4])), body[8:10]
+	case 0x21:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short v2 address block", errBadProxyHeader)
+		}
+		ip, port = netip.AddrFrom16([16]byte(body[0:16])), body[32:34]
+	default:
+		// UDP, Unix sockets and unspecified families carry no client
+		// address for us.
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(port))), nil
+}
@@ -0,0 +1,198 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4 := netip.MustParseAddrPort("192.0.2.1:51000")
+	v4dst := netip.MustParseAddrPort("198.51.100.2:22")
+	v6 := netip.MustParseAddrPort("[2001:db8::1]:51000")
+	v6dst := netip.MustParseAddrPort("[2001:db8::2]:22")
+	sig := hex.EncodeToString(proxyV2Signature)
+	tests := []struct {
+		version  string
+		src, dst netip.AddrPort
+		want     string // v1 as text, v2 as hex
+	}{
+		{ProxyProtocolV1, v4, v4dst, "PROXY TCP4 192.0.2.1 198.51.100.2 51000 22\r\n"},
+		{ProxyProtocolV1, v6, v6dst, "PROXY TCP6 2001:db8::1 2001:db8::2 51000 22\r\n"},
+		{ProxyProtocolV1, netip.MustParseAddrPort("[::ffff:192.0.2.1]:51000"), v4dst, "PROXY TCP4 192.0.2.1 198.51.100.2 51000 22\r\n"},
+		{ProxyProtocolV1, v4, v6dst, "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 51000 22\r\n"},
+		{ProxyProtocolV1, v4, netip.AddrPort{}, "PROXY TCP4 192.0.2.1 0.0.0.0 51000 0\r\n"},
+		{ProxyProtocolV1, netip.AddrPort{}, v4dst, "PROXY UNKNOWN\r\n"},
+		{ProxyProtocolV2, v4, v4dst, sig + "2111000c" + "c0000201" + "c6336402" + "c738" + "0016"},
+		{ProxyProtocolV2, v6, v6dst, sig + "21210024" +
+			"20010db8000000000000000000000001" + "20010db8000000000000000000000002" + "c738" + "0016"},
+		{ProxyProtocolV2, netip.AddrPort{}, v4dst, sig + "20000000"},
+	}
+	for _, tt := range tests {
+		got := proxyHeader(tt.version, tt.src, tt.dst)
+		want := tt.want
+		if tt.version == ProxyProtocolV2 {
+			got = []byte(hex.EncodeToString(got))
+		}
+		if string(got) != want {
+			t.Errorf("proxyHeader(%s, %s, %s) = %q, want %q", tt.version, tt.src, tt.dst, got, want)
+		}
+	}
+}
+
+func TestReadProxyHeaderRoundTrip(t *testing.T) {
+	dst := netip.MustParseAddrPort("198.51.100.2:22")
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		for _, src := range []string{"192.0.2.1:51000", "[2001:db8::1]:443"} {
+			ap := netip.MustParseAddrPort(src)
+			data := append(proxyHeader(version, ap, dst), "SSH-2.0-x\r\n"...)
+			r := bufio.NewReader(bytes.NewReader(data))
+			addr, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatalf("%s %s: %v", version, src, err)
+			}
+			tcp, ok := addr.(*net.TCPAddr)
+			if !ok || netip.AddrPortFrom(tcp.AddrPort().Addr().Unmap(), tcp.AddrPort().Port()) != ap {
+				t.Errorf("%s %s: read %v", version, src, addr)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "SSH-2.0-x\r\n" {
+				t.Errorf("%s %s: left %q after the header", version, src, rest)
+			}
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, family byte, body string) string {
+		b, _ := hex.DecodeString(body)
+		return string(proxyV2Signature) + string([]byte{cmd, family, byte(len(b) >> 8), byte(len(b))}) + string(b)
+	}
+	tests := []struct {
+		name string
+		in   string
+		addr string // empty for none
+		bad  bool   // errBadProxyHeader
+		err  bool   // any other error
+		rest string
+	}{
+		{name: "no header", in: "GET / HTTP/1.1\r\n", rest: "GET / HTTP/1.1\r\n"},
+		{name: "v1", in: "PROXY TCP4 192.0.2.1 198.51.100.2 51000 22\r\nx", addr: "192.0.2.1:51000", rest: "x"},
+		{name: "v1 unknown", in: "PROXY UNKNOWN 1 2 3 4\r\nx", rest: "x"},
+		{name: "v1 too long", in: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", bad: true},
+		{name: "v1 missing field", in: "PROXY TCP4 192.0.2.1 198.51.100.2 51000\r\n", bad: true},
+		{name: "v1 bad family", in: "PROXY UDP4 192.0.2.1 198.51.100.2 51000 22\r\n", bad: true},
+		{name: "v1 bad address", in: "PROXY TCP4 192.0.2 198.51.100.2 51000 22\r\n", bad: true},
+		{name: "v1 bad port", in: "PROXY TCP4 192.0.2.1 198.51.100.2 70000 22\r\n", bad: true},
+		{name: "v1 truncated", in: "PROXY TCP4 192.0.2.1", err: true},
+		{name: "v2 local", in: v2(0x20, 0x00, "") + "x", rest: "x"},
+		{name: "v2 unix", in: v2(0x21, 0x31, strings.Repeat("00", 216)) + "x", rest: "x"},
+		{name: "v2 with TLVs", in: v2(0x21, 0x11, "c0000201c6336402c7380016"+"0300040000000000") + "x", addr: "192.0.2.1:51000", rest: "x"},
+		{name: "v2 version 1", in: v2(0x11, 0x11, "c0000201c6336402c7380016"), bad: true},
+		{name: "v2 short ipv4", in: v2(0x21, 0x11, "c0000201"), bad: true},
+		{name: "v2 short ipv6", in: v2(0x21, 0x21, "c0000201c6336402c7380016"), bad: true},
+		{name: "v2 truncated", in: v2(0x21, 0x11, "c0000201c6336402c7380016")[:20], err: true},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.in))
+		addr, err := readProxyHeader(r)
+		switch {
+		case tt.bad:
+			if !errors.Is(err, errBadProxyHeader) {
+				t.Errorf("%s: error %v, want %v", tt.name, err, errBadProxyHeader)
+			}
+			continue
+		case tt.err:
+			if err == nil || errors.Is(err, errBadProxyHeader) {
+				t.Errorf("%s: error %v, want a read error", tt.name, err)
+			}
+			continue
+		case err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := ""; addr != nil {
+			got = addr.String()
+			if got != tt.addr {
+				t.Errorf("%s: addr %s, want %q", tt.name, got, tt.addr)
+			}
+		} else if len(tt.addr) != 0 {
+			t.Errorf("%s: no addr, want %s", tt.name, tt.addr)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != tt.rest {
+			t.Errorf("%s: left %q, want %q", tt.name, rest, tt.rest)
+		}
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	tp, err := NewTrustedProxies([]string{"10.0.0.0/24", "2001:db8::1", "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote string
+		xff    []string
+		client string // empty for none
+	}{
+		{"10.0.0.1:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"203.0.113.7", "10.0.0.2"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:1234", []string{"[2001:db8::7]"}, "2001:db8::7"},
+		{"10.0.0.1:1234", []string{"::ffff:203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"garbage, 203.0.113.7"}, "203.0.113.7"},
+		{"10.0.0.1:1234", []string{"1.2.3.4, garbage, 10.0.0.2"}, ""},
+		{"10.0.0.1:1234", []string{"203.0.113.7:5555"}, ""},
+		{"10.0.0.1:1234", []string{""}, ""},
+		{"10.0.0.1:1234", nil, ""},
+		{"[2001:db8::1]:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"[::ffff:10.0.0.1]:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"@", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"/run/gowasmssh.sock", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"192.0.2.1:1234", []string{"203.0.113.7"}, ""},
+		{"[2001:db8::2]:1234", []string{"203.0.113.7"}, ""},
+	}
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remote, Header: http.Header{"X-Forwarded-For": tt.xff}}
+		ip, ok := tp.forwardedFor(r)
+		got := ""
+		if ok {
+			got = ip.String()
+		}
+		if got != tt.client {
+			t.Errorf("forwardedFor(%s, %q) = %q, want %q", tt.remote, tt.xff, got, tt.client)
+		}
+	}
+
+	noUnix, err := NewTrustedProxies([]string{"10.0.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &http.Request{RemoteAddr: "@", Header: http.Header{"X-Forwarded-For": {"203.0.113.7"}}}
+	if ip, ok := noUnix.forwardedFor(r); ok {
+		t.Errorf("forwardedFor without unix trusted a Unix peer: %s", ip)
+	}
+	var none *TrustedProxies
+	if ip, ok := none.forwardedFor(r); ok {
+		t.Errorf("nil TrustedProxies returned %s", ip)
+	}
+}
+
+func TestNewTrustedProxiesErrors(t *testing.T) {
+	for _, entry := range []string{"10.0.0.0/33", "example.com", "unix:/run/x.sock", ""} {
+		if _, err := NewTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("NewTrustedProxies(%q) succeeded, want an error", entry)
+		}
+	}
+}
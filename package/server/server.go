@@ -5,226 +5,651 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/net/websocket"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+// StatusPolicyDenied is the status of a target refused by the destination
+// policy, so clients can tell it apart from a rejected Origin (403).
+// Multiplexed streams, refused after their session was upgraded, are closed
+// with it plus 4000.
+const StatusPolicyDenied = http.StatusUnavailableForLegalReasons
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+	// forceCloseGrace lets force-closed tunnels send their close frame.
+	forceCloseGrace = 10 * time.Second
 )
 
 type WsToTcpServer struct {
 	// Addr is the address to listen on.
-	Addr   string
-	Port   int
-	ctx    context.Context
-	server *http.Server
+	Addr string
+	Port int
+	// Listeners replace Addr and Port when set, the tunnel endpoint is
+	// served on all of them.
+	Listeners []ListenerConfig
+	// TLS serves HTTPS, optionally requiring client certificates, when set.
+	TLS *CertReloader
+	// MetricsAddr serves /metrics on a separate listener when set,
+	// otherwise it is served next to the tunnel endpoint to admins only.
+	MetricsAddr string
+	// AdminAddr serves the admin API on a separate listener when set,
+	// otherwise it is served under /admin/ when Settings enable it.
+	AdminAddr string
+	// BasePath is the URL prefix everything is served under, in the form
+	// CleanBasePath returns, e.g. "/tools/ssh" behind an ingress.
+	BasePath string
+	// StaticDir serves the web page from this directory instead of the
+	// embedded bundle.
+	StaticDir string
+	// Version is reported on /version, the module version from the build
+	// info is used when it is empty.
+	Version string
+	// Logger receives server messages and one access record per tunnel,
+	// slog.Default is used when it is nil.
+	Logger        *slog.Logger
+	ctx           context.Context
+	settings      atomic.Pointer[Settings]
+	server        *http.Server
+	metricsServer *http.Server
+	adminServer   *http.Server
+	metrics       *Metrics
+	tunnels       *tunnelRegistry
+	events        *tunnelEvents
+	draining      atomic.Bool
+	// drain is closed when Shutdown starts.
+	drain  chan struct{}
+	canary canaryProbe
+	build  BuildInfo
 }
 
 func NewWsToTcpServer(ctx context.Context, addr string, port int) *WsToTcpServer {
 	return &WsToTcpServer{
-		Addr:   addr,
-		Port:   port,
-		ctx:    ctx,
-		server: nil,
-	}
-}
-
-func ping(ctx context.Context, conn *websocket.Conn) {
-	w, err := conn.NewFrameWriter(websocket.PingFrame)
-	if err != nil {
-		return
-	}
-	ticker := time.NewTicker(20 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			_, err := w.Write(nil)
-			if err != nil {
-				return
-			}
-		case <-ctx.Done():
-			return
-		}
+		Addr:    addr,
+		Port:    port,
+		ctx:     ctx,
+		server:  nil,
+		metrics: NewMetrics(),
+		tunnels: newTunnelRegistry(),
+		events:  newTunnelEvents(),
+		drain:   make(chan struct{}),
 	}
 }
 
-func parseOrigin(origin string) (string, error) {
+func parseOrigin(origin string) (scheme, host, port string, err error) {
 	u, err := url.Parse(origin)
 	if err != nil {
-		return "", err
+		return "", "", "", err
 	}
-	host, _, err := net.SplitHostPort(u.Host)
+	if len(u.Host) == 0 {
+		return "", "", "", errors.New("origin has no host")
+	}
+	scheme = strings.ToLower(u.Scheme)
+	host, port, err = net.SplitHostPort(u.Host)
 	if err != nil {
 		var addrErr *net.AddrError
 		if errors.As(err, &addrErr) {
 			if strings.Contains(addrErr.Err, "missing port in address") {
-				return u.Host, nil
+				return scheme, strings.ToLower(strings.Trim(u.Host, "[]")), defaultPort(scheme), nil
 			}
 		}
-		return "", err
+		return "", "", "", err
 	}
-	return host, nil
+	return scheme, strings.ToLower(host), port, nil
 }
 
-func genWsHandler(ctx context.Context, server string, port int) websocket.Handler {
-	return websocket.Handler(func(conn *websocket.Conn) {
-		tcp, err := net.DialTimeout("tcp", net.JoinHostPort(server, fmt.Sprintf("%d", port)), 30*time.Second)
-		if err != nil {
-			conn.Close()
-			return
-		}
+// clientSide is the browser end of a tunnel, a whole WebSocket or one
+// stream of a multiplexed one.
+type clientSide interface {
+	IReaderWithTimeout
+	io.Writer
+	// keepalive detects a dead browser until done is closed.
+	keepalive(done <-chan struct{})
+	// sendControl sends the browser a control message.
+	sendControl(msg ControlMessage) error
+	// sendClose tells the browser the tunnel ends and why.
+	sendClose(code int, reason string) error
+	// Close drops the browser end.
+	Close() error
+}
 
-		// 创建子上下文用于管理这个连接的goroutine
-		connCtx, cancel := context.WithCancel(ctx)
-		defer cancel()
+func (s *WsToTcpServer) serveTunnel(ctx context.Context, conn clientSide, t *tunnel) {
+	t.start = time.Now()
+	defer func() {
+		t.end = time.Now()
+		s.logger().LogAttrs(ctx, slog.LevelInfo, "tunnel", t.logAttrs()...)
+		s.events.publish(eventClose, t)
+	}()
+	defer conn.Close()
+
+	// 创建子上下文用于管理这个连接的goroutine
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	t.cancel = cancel
+	t.conn = conn
+	s.tunnels.add(t)
+	defer s.tunnels.remove(t)
 
-		defer tcp.Close()
-		defer conn.Close()
+	st := t.settings
+	policy := st.policy()
+	if t.target != nil {
+		policy = t.target.policy
+	}
+	decision := policy.Evaluate(t.host, t.port)
+	var tcp net.Conn
+	var err error
+	if t.target != nil {
+		tcp, err = st.dialTarget(connCtx, t.target)
+	} else {
+		tcp, err = st.dial(connCtx, t.host, t.port)
+	}
+	if err == nil {
+		s.metrics.dialed(time.Since(t.start))
+	}
+	if err == nil && len(decision.ProxyProtocol) != 0 {
+		// The header must precede everything else sent to the target.
+		if err = writeProxyHeader(tcp, decision.ProxyProtocol, t); err != nil {
+			tcp.Close()
+			err = fmt.Errorf("send PROXY header: %w", err)
+		}
+	}
+	if err != nil {
+		reason := dialFailureReason(err)
+		t.setCloseReason(reason + ": " + err.Error())
+		s.metrics.tunnelFailed(reason)
+		conn.sendControl(dialErrors[reason])
+		conn.sendClose(websocket.CloseInternalServerErr, reason)
+		return
+	}
+	t.dialed(tcp)
+	s.metrics.tunnelOpened()
+	s.events.publish(eventOpen, t)
+	defer func() {
+		s.metrics.tunnelClosed(time.Since(t.start))
+	}()
+	defer tcp.Close()
 
-		conn.PayloadType = websocket.BinaryFrame
+	var wg sync.WaitGroup
+	inChan := make(chan int, 10)
+	outChan := make(chan int, 10)
+	stopChan := make(chan struct{}, 2)
+	clientDone := make(chan struct{})
 
-		var wg sync.WaitGroup
-		done := make(chan struct{})
-		countChan := make(chan int, 10)
-		stopChan := make(chan struct{}, 2)
+	// Ping goroutine
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn.keepalive(connCtx.Done())
+	}()
 
-		// Ping goroutine
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			ping(connCtx, conn)
-		}()
+	// Close goroutine, once the tunnel is torn down the browser is told why
+	// and gets closeGrace to answer before both sockets are closed, which
+	// also unblocks the copiers.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-connCtx.Done()
+		// Decides the reason when the server context ended the tunnel and
+		// makes the decided one safe to read.
+		t.closeWith(CloseGoingAway, "server shutdown")
+		code := t.closeCode
+		if code == 0 {
+			code = websocket.CloseNormalClosure
+		}
+		if errCode, ok := closeErrorCodes[code]; ok {
+			conn.sendControl(errorMessage(errCode, t.closeReason, 0))
+		}
+		conn.sendClose(code, t.closeReason)
+		select {
+		case <-clientDone:
+		case <-time.After(closeGrace):
+		}
+		conn.Close()
+		tcp.Close()
+	}()
 
-		// Copy goroutines
-		copier := func(from IReaderWithTimeout, to io.Writer) {
-			defer wg.Done()
-			err := copyData(connCtx, from, to, countChan, stopChan)
-			if err != nil {
-				fmt.Printf("Copy error: %v\n", err)
+	// Copy goroutines, the tunnel is torn down as soon as either
+	// direction ends and the first one to end names the reason.
+	inLimits, outLimits, release := st.Bandwidth.acquire(t.clientIP)
+	defer release()
+	copier := func(from IReaderWithTimeout, to io.Writer, counter chan<- int, side string, limiters []*rate.Limiter) {
+		defer wg.Done()
+		defer cancel()
+		err := copyData(connCtx, from, to, counter, stopChan, limiters)
+		var closeErr *websocket.CloseError
+		switch {
+		case err == nil || errors.Is(err, io.EOF):
+			t.setCloseReason(side + " closed")
+		case errors.Is(err, context.Canceled):
+		case errors.As(err, &closeErr):
+			switch closeErr.Code {
+			case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived:
+				t.setCloseReason(side + " closed")
+			case websocket.CloseAbnormalClosure:
+				t.setCloseReason(side + " disconnected")
+			default:
+				t.setCloseReason(fmt.Sprintf("%s closed with code %d", side, closeErr.Code))
 			}
+		default:
+			t.closeWith(websocket.CloseInternalServerErr, side+" error: "+err.Error())
 		}
+	}
 
-		wg.Add(2)
-		go copier(conn, tcp)
-		go copier(tcp, conn)
+	// The target's SSH host key is tracked and both sides are made to speak
+	// SSH when configured.
+	var client, target IReaderWithTimeout = conn, tcp
+	if hk := st.HostKeys; hk != nil {
+		target = &sshWatcher{IReaderWithTimeout: target, onHostKey: func(key ssh.PublicKey) error {
+			return s.checkHostKey(t, hk, key)
+		}}
+	}
+	if decision.RequireSSH {
+		var stop func()
+		client, target, stop = s.guardSSH(connCtx, t, st, cancel, client, target)
+		defer stop()
+	}
 
-		total := 0
+	wg.Add(2)
+	go func() {
+		defer close(clientDone)
+		copier(client, tcp, inChan, "client", inLimits)
+	}()
+	go copier(target, conn, outChan, "target", outLimits)
 
-		// Monitor total transfer size
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				select {
-				case <-connCtx.Done():
-					return
-				case <-done:
-					return
-				case count := <-countChan:
-					total += count
-
-				}
+	t.touch()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.watch(connCtx, cancel, st.IdleTimeout, st.MaxLifetime)
+	}()
+
+	// Monitor transfer size of both directions
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-connCtx.Done():
+				return
+			case count := <-inChan:
+				t.touch()
+				t.bytesIn.Add(int64(count))
+				s.metrics.addBytes(dirIn, count)
+			case count := <-outChan:
+				t.touch()
+				t.bytesOut.Add(int64(count))
+				s.metrics.addBytes(dirOut, count)
 			}
-		}()
+		}
+	}()
 
-		// 等待所有goroutine完成或上下文取消
-		wg.Wait()
-		close(countChan)
-		close(stopChan)
-	})
+	// 等待所有goroutine完成或上下文取消
+	wg.Wait()
+	close(inChan)
+	close(outChan)
+	close(stopChan)
 }
 
-func (s *WsToTcpServer) wsUpgradeHandler(w http.ResponseWriter, r *http.Request) {
-	origin := r.Header.Get("Origin")
-	if len(origin) == 0 {
+// checkUpgrade answers r and returns false unless it is a WebSocket
+// upgrade from an allowed Origin.
+func (s *WsToTcpServer) checkUpgrade(w http.ResponseWriter, r *http.Request, st *Settings) bool {
+	if err := st.origins().Check(r.Header.Get("Origin")); err != nil {
+		s.logger().Warn("rejected origin", "path", r.URL.Path, "client_ip", clientIP(r), "error", err)
+		s.metrics.tunnelFailed(failOrigin)
 		http.Error(w, "not allow", http.StatusForbidden)
+		return false
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return false
+	}
+	return true
+}
+
+func (s *WsToTcpServer) wsUpgradeHandler(w http.ResponseWriter, r *http.Request) {
+	st := s.current()
+	if !s.checkUpgrade(w, r, st) {
 		return
 	}
-	host, err := parseOrigin(origin)
-	if err != nil {
-		http.Error(w, "not allow", http.StatusForbidden)
+	remoteAddr := strings.Trim(r.PathValue("server"), "[]")
+	portAddr := r.PathValue("port")
+	if len(remoteAddr) == 0 || len(portAddr) == 0 {
+		s.metrics.tunnelFailed(failBadRequest)
+		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	if host != "localhost" && host != "wrtx.dev" && host != "www.wrtx.dev" {
-		http.Error(w, "not allow", http.StatusForbidden)
+	port, err := strconv.Atoi(portAddr)
+	if err != nil || port < 1 || port > 65535 {
+		s.metrics.tunnelFailed(failBadRequest)
+		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	connection := r.Header.Get("Connection")
-	if strings.ToLower(connection) != "upgrade" {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
+	s.openTunnel(w, r, st, remoteAddr, port, nil)
+}
+
+// wsAliasHandler opens a tunnel to the catalog target named in the path.
+func (s *WsToTcpServer) wsAliasHandler(w http.ResponseWriter, r *http.Request) {
+	st := s.current()
+	if !s.checkUpgrade(w, r, st) {
 		return
 	}
-	remoteAddr := r.PathValue("server")
-	portAddr := r.PathValue("port")
-	if len(remoteAddr) == 0 || len(portAddr) == 0 {
-		http.Error(w, "bad request", http.StatusBadRequest)
+	name := r.PathValue("name")
+	target, ok := st.Targets.Lookup(name)
+	if !ok {
+		s.logger().Warn("unknown target", "target", name, "client_ip", clientIP(r))
+		s.metrics.tunnelFailed(failBadRequest)
+		refuse(w, errUnknownTarget)
 		return
 	}
-	if isLocalIP(remoteAddr) {
-		http.Error(w, "bad request", http.StatusForbidden)
+	s.openTunnel(w, r, st, target.Host, target.Port, target)
+}
+
+// openTunnel admits a tunnel to host:port, or to target when it is set,
+// and serves it over the upgraded connection.
+func (s *WsToTcpServer) openTunnel(w http.ResponseWriter, r *http.Request, st *Settings, host string, port int, target *Target) {
+	user, release, refused := s.admit(r, st, host, port, target, r.URL.Query().Get("ticket"))
+	if refused != nil {
+		refuse(w, refused)
 		return
 	}
-	port, err := strconv.Atoi(portAddr)
+	defer release()
+
+	t := newTunnel(r, st, host, port)
+	t.user = user
+	t.target = target
+	conn, err := st.WebSocket.upgrader().Upgrade(w, r, nil)
 	if err != nil {
-		http.Error(w, "bad request", http.StatusBadRequest)
+		// Upgrade already answered the request.
+		s.logger().Warn("upgrade failed", "target", net.JoinHostPort(host, strconv.Itoa(port)), "client_ip", clientIP(r), "error", err)
+		s.metrics.tunnelFailed(failBadRequest)
 		return
 	}
+	s.serveTunnel(s.ctx, newWsStream(conn, st.WebSocket), t)
+}
+
+// refuse answers a refused upgrade with the status of the refusal, nothing
+// is upgraded or dialed for it.
+func refuse(w http.ResponseWriter, refused *admitError) {
+	if refused.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(refused.retryAfter.Seconds()))))
+	}
+	http.Error(w, refused.msg, refused.status)
+}
+
+// admitError is a refused tunnel.
+type admitError struct {
+	// status is the HTTP status of the refusal, code its control message
+	// error code and msg is shown to the browser.
+	status     int
+	code       string
+	msg        string
+	retryAfter time.Duration
+}
+
+var errUnknownTarget = &admitError{status: http.StatusNotFound, code: ErrCodeUnknownTarget, msg: "unknown target"}
+
+func (e *admitError) Error() string {
+	return e.msg
+}
+
+func (e *admitError) message() ControlMessage {
+	return errorMessage(e.code, e.msg, e.retryAfter)
+}
+
+// admit runs the checks a tunnel to host:port must pass once its Origin is
+// accepted: ticket, destination policy, draining and connection limits.
+// target is the catalog entry host:port was taken from, the policy does not
+// apply to it, nil when the browser named the address. The caller must call
+// release once the tunnel ends.
+func (s *WsToTcpServer) admit(r *http.Request, st *Settings, host string, port int, target *Target, ticket string) (user string, release func(), refused *admitError) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	if st.Tickets != nil {
+		claims, err := st.Tickets.Verify(ticket, host, port)
+		if err != nil {
+			s.logger().Warn("rejected ticket", "target", addr, "client_ip", clientIP(r), "error", err)
+			s.metrics.tunnelFailed(failTicket)
+			return "", nil, &admitError{status: http.StatusUnauthorized, code: ErrCodeUnauthorized, msg: "unauthorized"}
+		}
+		user = claims.User
+	}
+	if target == nil {
+		if refused := s.admitAddress(r, st, host, port, user); refused != nil {
+			return "", nil, refused
+		}
+	}
+
+	// A draining server refuses before a rate token is spent on a tunnel
+	// it would not open.
+	if s.draining.Load() {
+		return "", nil, &admitError{status: http.StatusServiceUnavailable, code: ErrCodeShuttingDown, msg: "server shutting down", retryAfter: 5 * time.Second}
+	}
+	release = func() {}
+	if st.Limits != nil {
+		var retryAfter time.Duration
+		var err error
+		release, retryAfter, err = st.Limits.acquire(clientIP(r))
+		if err != nil {
+			reason, code := failTooManyTunnels, ErrCodeTooManyTunnels
+			if errors.Is(err, ErrRateLimited) {
+				reason, code = failRateLimited, ErrCodeRateLimited
+			}
+			s.logger().Warn("limited tunnel", "target", addr, "client_ip", clientIP(r), "user", user, "error", err)
+			s.metrics.tunnelFailed(reason)
+			return "", nil, &admitError{status: http.StatusTooManyRequests, code: code, msg: err.Error(), retryAfter: retryAfter}
+		}
+	}
+	return user, release, nil
+}
 
-	websocket.Handler(genWsHandler(s.ctx, remoteAddr, port)).ServeHTTP(w, r)
+// admitAddress checks a host:port the browser named against the target
+// catalog and the destination policy.
+func (s *WsToTcpServer) admitAddress(r *http.Request, st *Settings, host string, port int, user string) *admitError {
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	denied := &admitError{status: StatusPolicyDenied, code: ErrCodePolicyDenied, msg: "destination not allowed"}
+	if st.Targets.exclusive() {
+		s.logger().Warn("denied destination", "target", target, "client_ip", clientIP(r), "user", user, "error", "not in the target catalog")
+		s.metrics.tunnelFailed(failPolicy)
+		return denied
+	}
+	policy := st.policy()
+	decision := policy.Evaluate(host, port)
+	if !decision.Allow {
+		s.logger().Warn("denied destination", "target", target, "client_ip", clientIP(r), "user", user, "rule", decision.String())
+		s.metrics.tunnelFailed(failPolicy)
+		return denied
+	}
+	// Literal addresses can be refused before the upgrade, hostnames are
+	// checked by the dialer once resolved.
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if err := checkAddr(policy, netip.AddrPortFrom(addr, uint16(port))); err != nil {
+			s.logger().Warn("denied destination", "target", target, "client_ip", clientIP(r), "user", user, "error", err)
+			s.metrics.tunnelFailed(failPolicy)
+			return denied
+		}
+	}
+	return nil
 }
 
-func (s *WsToTcpServer) Serve(staticFS embed.FS) {
-	var staticFiles = fs.FS(staticFS)
-	sub, err := fs.Sub(staticFiles, "webpage/dist")
+// Serve runs the server until Shutdown is called. It returns nil once the
+// server was shut down.
+func (s *WsToTcpServer) Serve(staticFS embed.FS) error {
+	sub, err := s.webFS(staticFS)
 	if err != nil {
-		fmt.Println("can't load embed files")
-		return
+		s.logger().Error("can't load web files", "error", err)
+		return err
+	}
+	s.build = buildInfo(s.Version)
+	if s.build.BundleSHA256, err = bundleHash(sub); err != nil {
+		s.logger().Error("can't hash web files", "error", err)
+		return err
+	}
+	listeners, err := s.listen()
+	if err != nil {
+		s.logger().Error("listen failed", "error", err)
+		return err
 	}
 	hfs := http.FileServer(http.FS(sub))
 	mux := http.NewServeMux()
 	mux.Handle("/", hfs)
+	mux.HandleFunc("GET /env.js", s.envScript)
+	mux.HandleFunc("GET /healthz", s.healthz)
+	mux.HandleFunc("GET /readyz", s.readyz)
+	mux.HandleFunc("GET /version", s.version)
 	mux.Handle("/ws/{server}/{port}", http.HandlerFunc(s.wsUpgradeHandler))
+	mux.Handle("/ws/alias/{name}", http.HandlerFunc(s.wsAliasHandler))
+	mux.HandleFunc("GET /targets", s.targetsHandler)
+	mux.Handle("/ws/mux", http.HandlerFunc(s.muxHandler))
+	mux.Handle("POST /ticket", http.HandlerFunc(s.ticketHandler))
+	if len(s.MetricsAddr) == 0 {
+		// Tunnel counts, failure reasons and upstreams are not for anyone
+		// who can reach the page.
+		mux.Handle("GET /metrics", s.adminOnly(s.metrics))
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", s.metrics)
+		s.metricsServer = s.serveSide("metrics", s.MetricsAddr, metricsMux)
+	}
+	if len(s.AdminAddr) == 0 {
+		mux.Handle("/admin/", s.adminHandler())
+	} else {
+		s.adminServer = s.serveSide("admin", s.AdminAddr, s.adminHandler())
+	}
 	server := http.Server{
-		Addr:    net.JoinHostPort(s.Addr, fmt.Sprintf("%d", s.Port)),
-		Handler: mux,
+		Handler: s.forwarded(s.mount(mux)),
 	}
 	s.server = &server
-	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		fmt.Println("serve err:", err)
+	if s.TLS != nil {
+		s.server.TLSConfig = s.TLS.TLSConfig()
+		// WebSocket upgrades need HTTP/1.1, an empty map keeps ServeTLS
+		// from offering h2 on its own.
+		s.server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		s.logger().Info("listening", "network", l.Addr().Network(), "addr", l.Addr().String())
+		go func() {
+			if s.TLS != nil {
+				errc <- s.server.ServeTLS(l, "", "")
+			} else {
+				errc <- s.server.Serve(l)
+			}
+		}()
+	}
+	// Shutdown ends every Serve with ErrServerClosed, any other error takes
+	// the remaining listeners down too.
+	for range listeners {
+		if err := <-errc; err != nil && err != http.ErrServerClosed {
+			s.logger().Error("serve failed", "error", err)
+			s.server.Close()
+			return err
+		}
 	}
+	return nil
 }
 
-func (s *WsToTcpServer) Shutdown() {
-	if s.server != nil {
-		s.server.Shutdown(s.ctx)
+// listen opens Listeners, or Addr and Port when there are none.
+func (s *WsToTcpServer) listen() ([]net.Listener, error) {
+	cfgs := s.Listeners
+	if len(cfgs) == 0 {
+		cfgs = []ListenerConfig{{Address: net.JoinHostPort(s.Addr, strconv.Itoa(s.Port))}}
+	}
+	var listeners []net.Listener
+	for i := range cfgs {
+		ls, err := cfgs[i].listen()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		for _, l := range ls {
+			listeners = append(listeners, &proxyListener{Listener: l, s: s})
+		}
 	}
+	return listeners, nil
 }
 
-func isLocalIP(ip string) bool {
-	localIPs := []string{"127.0.0.1", "localhost", "::1", "0.0.0.0"}
-
-	for _, localIP := range localIPs {
-		if ip == localIP {
-			return true
+// serveSide serves handler on a plain HTTP listener next to the main one.
+func (s *WsToTcpServer) serveSide(name, addr string, handler http.Handler) *http.Server {
+	server := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.logger().Error(name+" serve failed", "error", err)
 		}
+	}()
+	return server
+}
+
+// Shutdown stops accepting connections and drains open tunnels: they are
+// told at once and get DrainTimeout to end on their own, then the rest are
+// sent a going-away close frame and torn down. It returns once every tunnel is gone or
+// forceCloseGrace passed after that.
+func (s *WsToTcpServer) Shutdown() {
+	if !s.draining.Swap(true) {
+		close(s.drain)
+	}
+	drain := s.current().DrainTimeout
+	if drain <= 0 {
+		drain = defaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	// Browsers can reconnect to another server during the drain instead
+	// of being cut off at its end. A slow browser must not hold up the
+	// others.
+	notice := drainingMessage(drain)
+	for _, t := range s.tunnels.list() {
+		go t.conn.sendControl(notice)
 	}
 
-	parsedIP := net.ParseIP(ip)
-	if parsedIP != nil {
-		return parsedIP.IsLoopback() || parsedIP.IsPrivate() || parsedIP.IsUnspecified()
+	// Event streams never end on their own, close them so the servers can
+	// shut down.
+	s.events.close()
+	if s.metricsServer != nil {
+		s.metricsServer.Shutdown(ctx)
+	}
+	if s.adminServer != nil {
+		s.adminServer.Shutdown(ctx)
+	}
+	// http.Server does not track hijacked connections, so this only stops
+	// the listeners and waits for plain requests.
+	if s.server != nil {
+		s.server.Shutdown(ctx)
+	}
+	if n := s.tunnels.len(); n != 0 {
+		s.logger().Info("draining tunnels", "tunnels", n, "timeout", drain.String())
+	}
+	if s.tunnels.wait(ctx) {
+		return
 	}
 
-	return false
+	open := s.tunnels.list()
+	s.logger().Warn("closing tunnels after drain timeout", "tunnels", len(open))
+	for _, t := range open {
+		t.closeWith(CloseGoingAway, "server shutting down")
+		t.cancel()
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), forceCloseGrace)
+	defer cancel()
+	s.tunnels.wait(ctx)
 }
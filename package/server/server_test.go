@@ -0,0 +1,151 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTunnel opens a plain tunnel to 127.0.0.1:port and waits for it to
+// carry data, the target must echo.
+func dialTunnel(t *testing.T, url string, port int) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s/ws/127.0.0.1/%d", url, port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	echoTunnel(t, conn)
+	return conn
+}
+
+func echoTunnel(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if typ, msg, err := conn.ReadMessage(); err != nil || typ != websocket.BinaryMessage || string(msg) != "ping" {
+		t.Fatalf("echo: %d %q, %v", typ, msg, err)
+	}
+}
+
+// readControl reads the next control message of a plain tunnel.
+func readControl(t *testing.T, conn *websocket.Conn) ControlMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typ, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m ControlMessage
+	if typ != websocket.TextMessage || json.Unmarshal(msg, &m) != nil {
+		t.Fatalf("read %d %q, want a control message", typ, msg)
+	}
+	return m
+}
+
+func TestRefusedUpgrade(t *testing.T) {
+	port := muxTestTarget(t, func(c net.Conn) { io.Copy(c, c) })
+	s, url := newTestServer(t, &Config{Limits: LimitConfig{RatePerIP: 0.1, BurstPerIP: 1}})
+	dial := func() (*http.Response, error) {
+		conn, resp, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s/ws/127.0.0.1/%d", url, port), nil)
+		if err == nil {
+			conn.Close()
+		}
+		return resp, err
+	}
+	tests := []struct {
+		draining bool
+		status   int
+	}{
+		// A draining server refuses without spending the rate token.
+		{true, http.StatusServiceUnavailable},
+		{false, http.StatusSwitchingProtocols},
+		{false, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		s.draining.Store(tt.draining)
+		resp, err := dial()
+		if resp == nil {
+			t.Fatalf("draining %v: %v", tt.draining, err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("draining %v: status %d, want %d", tt.draining, resp.StatusCode, tt.status)
+		}
+		if tt.status != http.StatusSwitchingProtocols && len(resp.Header.Get("Retry-After")) == 0 {
+			t.Errorf("status %d without Retry-After", resp.StatusCode)
+		}
+	}
+}
+
+func TestShutdownWaitsForTunnels(t *testing.T) {
+	port := muxTestTarget(t, func(c net.Conn) { io.Copy(c, c) })
+	s, url := newTestServer(t, &Config{Timeouts: TimeoutConfig{Drain: 10 * time.Second}})
+	conn := dialTunnel(t, url, port)
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Shutdown()
+	}()
+	if m := readControl(t, conn); m.Type != "draining" || m.Code != ErrCodeShuttingDown || m.CloseIn != 10 {
+		t.Errorf("notice %+v", m)
+	}
+	// The notice does not close the tunnel.
+	echoTunnel(t, conn)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown still waiting after the last tunnel closed")
+	}
+	if elapsed := time.Since(start); elapsed >= 5*time.Second {
+		t.Errorf("Shutdown took %v", elapsed)
+	}
+}
+
+func TestShutdownClosesAfterDrain(t *testing.T) {
+	const drain = 500 * time.Millisecond
+	port := muxTestTarget(t, func(c net.Conn) { io.Copy(c, c) })
+	s, url := newTestServer(t, &Config{Timeouts: TimeoutConfig{Drain: drain}})
+	conn := dialTunnel(t, url, port)
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Shutdown()
+	}()
+	if m := readControl(t, conn); m.Type != "draining" {
+		t.Errorf("notice %+v", m)
+	}
+	if m := readControl(t, conn); m.Type != "error" || m.Code != ErrCodeShuttingDown {
+		t.Errorf("close message %+v", m)
+	}
+	if elapsed := time.Since(start); elapsed < drain {
+		t.Errorf("tunnel closed after %v, before the drain timeout", elapsed)
+	}
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway {
+		t.Errorf("read after the close message: %v, want close %d", err, CloseGoingAway)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown still waiting after closing the tunnels")
+	}
+}
@@ -0,0 +1,165 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Settings is the part of the configuration that may change while the
+// server runs. Apply swaps it atomically, open tunnels keep the Settings
+// they were opened with so a reload never drops them.
+type Settings struct {
+	// TrustedProxies are believed about the client they forward, no peer
+	// is when it is nil.
+	TrustedProxies *TrustedProxies
+	// Origins restricts which browser origins may open tunnels,
+	// DefaultOrigins are used when it is nil.
+	Origins *OriginPolicy
+	// Policy decides which destinations may be dialed, every public
+	// destination is allowed when it is nil. It is checked against the
+	// requested host and again against every resolved address.
+	Policy *Policy
+	// Upstreams are the proxies the Policy may route destinations through.
+	Upstreams *Upstreams
+	// Targets are the named targets browsers may open tunnels to, there
+	// are none when it is nil.
+	Targets *Catalog
+	// HostKeys, when set, records the SSH host key of every target and
+	// reacts when it changes.
+	HostKeys *HostKeys
+	// Tickets, when set, requires every upgrade to carry a valid ticket
+	// query parameter and enables POST /ticket.
+	Tickets *Tickets
+	// Limits bounds the rate and number of tunnels per client IP and in
+	// total, nothing is limited when it is nil.
+	Limits *Limiter
+	// Bandwidth shapes traffic per tunnel, per client IP and in total, it
+	// is not shaped when nil. Tunnels keep the limits they were opened with.
+	Bandwidth *Shaper
+	// Admin enables the admin API when set.
+	Admin *Admin
+	// IdleTimeout closes tunnels without traffic in either direction for
+	// that long, MaxLifetime closes tunnels open for that long. Zero
+	// disables either.
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	// SSHBannerTimeout is how long tunnels that must speak SSH wait for
+	// the identification lines, defaultSSHBannerTimeout when zero.
+	SSHBannerTimeout time.Duration
+	// DrainTimeout is how long Shutdown waits for open tunnels to end on
+	// their own before closing them, defaultDrainTimeout when zero.
+	DrainTimeout time.Duration
+	// WebSocket tunes compression and the ping based detection of dead
+	// browsers.
+	WebSocket WebSocketConfig
+	// Health configures the canary dial of /readyz.
+	Health HealthConfig
+	// LogLevel is applied to loggers made by NewLogger.
+	LogLevel slog.Level
+}
+
+// NewSettings validates cfg and builds its run time components. Errors name
+// the offending config key.
+func NewSettings(cfg *Config) (*Settings, error) {
+	st := &Settings{
+		IdleTimeout:      cfg.Timeouts.Idle,
+		MaxLifetime:      cfg.Timeouts.MaxLifetime,
+		DrainTimeout:     cfg.Timeouts.Drain,
+		SSHBannerTimeout: cfg.Timeouts.SSHBanner,
+		WebSocket:        cfg.WebSocket,
+		Health:           cfg.Health,
+	}
+	var err error
+	if st.LogLevel, err = parseLogLevel(cfg.Log.Level); err != nil {
+		return nil, err
+	}
+	if err := cfg.Timeouts.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.WebSocket.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Health.validate(); err != nil {
+		return nil, err
+	}
+	if st.TrustedProxies, err = NewTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if st.Origins, err = cfg.Origins.OriginPolicy(); err != nil {
+		return nil, fmt.Errorf("origins.allow: %w", err)
+	}
+	if st.Policy, err = NewPolicy(cfg.Policy); err != nil {
+		return nil, err
+	}
+	if st.Upstreams, err = NewUpstreams(cfg.Upstreams, st.Policy); err != nil {
+		return nil, err
+	}
+	if st.Targets, err = NewCatalog(cfg.Targets, st.Policy, st.Upstreams); err != nil {
+		return nil, err
+	}
+	if st.HostKeys, err = NewHostKeys(cfg.HostKeys); err != nil {
+		return nil, err
+	}
+	if cfg.Tickets.Enabled() {
+		if st.Tickets, err = NewTickets(cfg.Tickets); err != nil {
+			return nil, err
+		}
+	}
+	if st.Limits, err = NewLimiter(cfg.Limits); err != nil {
+		return nil, err
+	}
+	if st.Bandwidth, err = NewShaper(cfg.Bandwidth); err != nil {
+		return nil, err
+	}
+	if cfg.Admin.Enabled() {
+		if st.Admin, err = NewAdmin(cfg.Admin); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+var zeroSettings = &Settings{}
+
+func (st *Settings) origins() *OriginPolicy {
+	if st.Origins == nil {
+		return defaultOriginPolicy
+	}
+	return st.Origins
+}
+
+func (st *Settings) policy() *Policy {
+	if st.Policy == nil {
+		return defaultPolicy
+	}
+	return st.Policy
+}
+
+// Apply makes next the settings of new tunnels and requests. Connection
+// limits, bandwidth buckets, unchanged upstreams and the host key store
+// carry over from the settings it replaces.
+func (s *WsToTcpServer) Apply(next *Settings) {
+	next.Upstreams.setLogger(s.logger())
+	if prev := s.settings.Load(); prev != nil {
+		if next.Limits != nil {
+			next.Limits.adopt(prev.Limits)
+		}
+		next.Bandwidth.adopt(prev.Bandwidth)
+		next.Upstreams.adopt(prev.Upstreams)
+		next.HostKeys.adopt(prev.HostKeys)
+	}
+	logLevel.Set(next.LogLevel)
+	s.settings.Store(next)
+}
+
+// current returns the settings in effect.
+func (s *WsToTcpServer) current() *Settings {
+	if st := s.settings.Load(); st != nil {
+		return st
+	}
+	return zeroSettings
+}
@@ -0,0 +1,85 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSettingsErrors(t *testing.T) {
+	tests := []struct {
+		key string
+		cfg Config
+	}{
+		{"log.level", Config{Log: LogConfig{Level: "loud"}}},
+		{"timeouts.idle", Config{Timeouts: TimeoutConfig{Idle: -time.Second}}},
+		{"timeouts.drain", Config{Timeouts: TimeoutConfig{Drain: -time.Second}}},
+		{"health.canary", Config{Health: HealthConfig{Canary: "nowhere"}}},
+		{"trusted_proxies", Config{TrustedProxies: []string{"example.com"}}},
+		{"origins.allow", Config{Origins: OriginConfig{Allow: []string{"https://"}}}},
+		{"policy.default", Config{Policy: PolicyConfig{Default: "maybe"}}},
+		{"targets.catalog[0]", Config{Targets: TargetsConfig{Catalog: []TargetConfig{{Name: "x"}}}}},
+		{"host_keys.on_change", Config{HostKeys: HostKeyConfig{OnChange: HostKeyBlock}}},
+		{"limits.max_per_ip", Config{Limits: LimitConfig{MaxPerIP: -1}}},
+		{"bandwidth.global", Config{Bandwidth: BandwidthConfig{Global: BandwidthLimit{Rate: 8192, Burst: 1}}}},
+		{"admin.users[0]", Config{Admin: AdminConfig{Users: []TicketUser{{ID: "ops"}}}}},
+	}
+	for _, tt := range tests {
+		st, err := NewSettings(&tt.cfg)
+		if err == nil {
+			t.Errorf("%s: NewSettings succeeded", tt.key)
+		} else if !strings.Contains(err.Error(), tt.key) {
+			t.Errorf("%s: error %q does not name the key", tt.key, err)
+		}
+		if st != nil {
+			t.Errorf("%s: settings returned with the error", tt.key)
+		}
+	}
+
+	st, err := NewSettings(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Tickets != nil || st.Admin != nil || st.Targets != nil || st.HostKeys != nil {
+		t.Errorf("empty config enabled %+v", st)
+	}
+}
+
+func TestApply(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	s := NewWsToTcpServer(context.Background(), "", 0)
+	if s.current() != zeroSettings {
+		t.Error("settings before the first Apply")
+	}
+	first, err := NewSettings(&Config{Limits: LimitConfig{MaxTotal: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Apply(first)
+	release, _, err := s.current().Limits.acquire("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	next, err := NewSettings(&Config{Limits: LimitConfig{MaxTotal: 1}, Log: LogConfig{Level: "debug"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Apply(next)
+	if s.current() != next {
+		t.Fatal("Apply did not make the settings current")
+	}
+	// The tunnel opened under the first settings still counts.
+	if _, _, err := s.current().Limits.acquire("192.0.2.2"); !errors.Is(err, ErrTooManyTunnels) {
+		t.Errorf("acquire after the reload = %v", err)
+	}
+	if logLevel.Level() != next.LogLevel {
+		t.Errorf("log level %v, want %v", logLevel.Level(), next.LogLevel)
+	}
+}
@@ -0,0 +1,176 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// CloseNotSSH closes tunnels that must speak SSH when either side does
+	// not.
+	CloseNotSSH = 4005
+
+	defaultSSHBannerTimeout = 10 * time.Second
+	// maxSSHIDLine is the longest identification line RFC 4253 allows,
+	// CR LF included.
+	maxSSHIDLine = 255
+)
+
+// sshIDPrefixes start the identification line of every SSH 2 peer, 1.99
+// is sent by servers that also speak SSH 1.
+var sshIDPrefixes = []string{"SSH-2.0-", "SSH-1.99-"}
+
+// sshPrefix starts the identification line and no line sent before it.
+const sshPrefix = "SSH-"
+
+var errNotSSH = errors.New("peer does not speak SSH")
+
+// sshGuard fails reads from a peer whose first bytes are not an SSH
+// identification line. Bytes are passed on as read as long as they can
+// still start one, so nothing of another protocol reaches the other side.
+// Servers may send other lines before it (RFC 4253 section 4.2), browsers
+// may not.
+type sshGuard struct {
+	IReaderWithTimeout
+	// fail is called with why the peer failed, its error is returned by
+	// Read.
+	fail func(reason string) error
+	// preamble allows lines before the identification line.
+	preamble bool
+	// after, when set, holds back reading until the other side passed or
+	// ctx ended, so none of the peer's bytes reach a target that turns out
+	// not to speak SSH.
+	after *sshGuard
+	ctx   context.Context
+
+	line    []byte
+	skipped int
+	passed  atomic.Bool
+	// ready is closed once passed is set.
+	ready chan struct{}
+}
+
+func (g *sshGuard) Read(p []byte) (int, error) {
+	if g.after != nil {
+		select {
+		case <-g.after.ready:
+			g.after = nil
+		case <-g.ctx.Done():
+			return 0, g.ctx.Err()
+		}
+	}
+	n, err := g.IReaderWithTimeout.Read(p)
+	if n > 0 && !g.passed.Load() {
+		if reason := g.check(p[:n]); len(reason) != 0 {
+			return 0, g.fail(reason)
+		}
+	}
+	return n, err
+}
+
+// guardSSH wraps the client and target sides of t so that t is closed
+// unless both open with an SSH identification line within the banner
+// timeout of st. Nothing is read from the client before the target sent
+// its line. The returned func stops the timer.
+func (s *WsToTcpServer) guardSSH(ctx context.Context, t *tunnel, st *Settings, cancel context.CancelFunc, client, target IReaderWithTimeout) (IReaderWithTimeout, IReaderWithTimeout, func()) {
+	var once sync.Once
+	fail := func(side, reason string) error {
+		once.Do(func() {
+			reason = side + " " + reason
+			s.logger().Warn("not an ssh tunnel", "id", t.id, "target", net.JoinHostPort(t.host, strconv.Itoa(t.port)),
+				"client_ip", t.clientIP, "user", t.user, "reason", reason)
+			s.metrics.tunnelFailed(failNotSSH)
+			t.closeWith(CloseNotSSH, reason)
+			cancel()
+		})
+		return errNotSSH
+	}
+	tg := &sshGuard{
+		IReaderWithTimeout: target,
+		fail:               func(reason string) error { return fail("target", reason) },
+		preamble:           true,
+		ready:              make(chan struct{}),
+	}
+	cg := &sshGuard{
+		IReaderWithTimeout: client,
+		fail:               func(reason string) error { return fail("client", reason) },
+		after:              tg,
+		ctx:                ctx,
+		ready:              make(chan struct{}),
+	}
+	timeout := st.SSHBannerTimeout
+	if timeout == 0 {
+		timeout = defaultSSHBannerTimeout
+	}
+	timer := time.AfterFunc(timeout, func() {
+		reason := "sent no SSH identification line in " + timeout.String()
+		if !tg.passed.Load() {
+			fail("target", reason)
+		} else if !cg.passed.Load() {
+			fail("client", reason)
+		}
+	})
+	return cg, tg, func() { timer.Stop() }
+}
+
+// check follows the identification line through p and returns why it is
+// not one, empty while it still may be.
+func (g *sshGuard) check(p []byte) string {
+	for len(p) != 0 {
+		end := bytes.IndexByte(p, '\n')
+		if end >= 0 {
+			g.line = append(g.line, p[:end]...)
+			p = p[end+1:]
+		} else {
+			g.line = append(g.line, p...)
+			p = nil
+		}
+		// Only the identification line starts with SSH-.
+		n := min(len(g.line), len(sshPrefix))
+		if g.preamble && (string(g.line[:n]) != sshPrefix[:n] || end >= 0 && n < len(sshPrefix)) {
+			if g.skipped+len(g.line)+1 > maxSSHPreamble {
+				return "sent no identification line in its first " + strconv.Itoa(maxSSHPreamble) + " bytes"
+			}
+			if end >= 0 {
+				g.skipped += len(g.line) + 1
+				g.line = g.line[:0]
+			}
+			continue
+		}
+		return g.checkIDLine(end >= 0)
+	}
+	return ""
+}
+
+// checkIDLine checks the identification line read so far, complete when
+// its end was read.
+func (g *sshGuard) checkIDLine(complete bool) string {
+	if len(g.line)+1 > maxSSHIDLine {
+		return "sent an overlong identification line"
+	}
+	for _, prefix := range sshIDPrefixes {
+		n := min(len(g.line), len(prefix))
+		if string(g.line[:n]) != prefix[:n] {
+			continue
+		}
+		if complete {
+			if n < len(prefix) {
+				continue
+			}
+			g.line = nil
+			g.passed.Store(true)
+			close(g.ready)
+		}
+		return ""
+	}
+	return "does not speak SSH"
+}
@@ -0,0 +1,119 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readerWithTimeout is an IReaderWithTimeout over an io.Reader.
+type readerWithTimeout struct {
+	io.Reader
+}
+
+func (readerWithTimeout) SetReadDeadline(time.Time) error { return nil }
+
+func TestSSHGuardCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		preamble bool
+		chunks   []string
+		passed   bool
+		fails    bool
+	}{
+		{name: "ssh 2", chunks: []string{"SSH-2.0-OpenSSH_9.6\r\n"}, passed: true},
+		{name: "ssh 1.99", chunks: []string{"SSH-1.99-Cisco\r\n"}, passed: true},
+		{name: "no cr", chunks: []string{"SSH-2.0-x\n"}, passed: true},
+		{name: "split", chunks: []string{"S", "SH-2", ".0-x", "\r\n"}, passed: true},
+		{name: "incomplete", chunks: []string{"SSH-2.0-x"}},
+		{name: "packet after line", chunks: []string{"SSH-2.0-x\r\n\x00\x00\x01\x00garbage"}, passed: true},
+		{name: "ssh 1", chunks: []string{"SSH-1.5-x\r\n"}, fails: true},
+		{name: "short version", chunks: []string{"SSH-2.0\r\n"}, fails: true},
+		{name: "http", chunks: []string{"GET / HTTP/1.1\r\n"}, fails: true},
+		{name: "redis", chunks: []string{"*1\r\n$4\r\nPING\r\n"}, fails: true},
+		{name: "first byte", chunks: []string{"G"}, fails: true},
+		{name: "empty line", chunks: []string{"\r\n"}, fails: true},
+		{name: "overlong", chunks: []string{"SSH-2.0-" + strings.Repeat("x", maxSSHIDLine)}, fails: true},
+		{name: "client preamble", chunks: []string{"hello\r\nSSH-2.0-x\r\n"}, fails: true},
+		{name: "preamble", preamble: true, chunks: []string{"hello\r\n\r\nSSH-2.0-x\r\n"}, passed: true},
+		{name: "preamble split", preamble: true, chunks: []string{"hel", "lo\r", "\nSS", "H-2.0-x\r\n"}, passed: true},
+		{name: "preamble pending", preamble: true, chunks: []string{"hello\r\n", "any"}},
+		{name: "preamble then ssh 1", preamble: true, chunks: []string{"hello\r\nSSH-1.5-x\r\n"}, fails: true},
+		{name: "preamble too long", preamble: true, chunks: []string{strings.Repeat("x\r\n", maxSSHPreamble/3+1)}, fails: true},
+		{name: "preamble line too long", preamble: true, chunks: []string{strings.Repeat("x", maxSSHPreamble)}, fails: true},
+		{name: "preamble silent", preamble: true, chunks: []string{"+OK\r\n"}},
+	}
+	for _, tt := range tests {
+		g := &sshGuard{preamble: tt.preamble, ready: make(chan struct{})}
+		var reason string
+		for _, chunk := range tt.chunks {
+			if reason = g.check([]byte(chunk)); len(reason) != 0 {
+				break
+			}
+		}
+		if fails := len(reason) != 0; fails != tt.fails {
+			t.Errorf("%s: failed %v (%q), want %v", tt.name, fails, reason, tt.fails)
+		}
+		if g.passed.Load() != tt.passed {
+			t.Errorf("%s: passed %v, want %v", tt.name, g.passed.Load(), tt.passed)
+		}
+	}
+}
+
+func TestSSHGuardHoldsClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fail := func(reason string) error { return errNotSSH }
+	targetR, targetW := io.Pipe()
+	tg := &sshGuard{IReaderWithTimeout: readerWithTimeout{targetR}, fail: fail, preamble: true, ready: make(chan struct{})}
+	cg := &sshGuard{
+		IReaderWithTimeout: readerWithTimeout{strings.NewReader("SSH-2.0-client\r\n*1\r\n$4\r\nPING\r\n")},
+		fail:               fail,
+		after:              tg,
+		ctx:                ctx,
+		ready:              make(chan struct{}),
+	}
+
+	read := make(chan string, 1)
+	go func() {
+		b := make([]byte, 64)
+		n, _ := cg.Read(b)
+		read <- string(b[:n])
+	}()
+	go func() {
+		targetW.Write([]byte("banner\r\n"))
+		targetW.Write([]byte("SSH-2.0-target\r\n"))
+	}()
+	b := make([]byte, 64)
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-read:
+			t.Fatalf("client read %q before the target identified", got)
+		default:
+		}
+		if _, err := tg.Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case got := <-read:
+		if !strings.HasPrefix(got, "SSH-2.0-client") {
+			t.Errorf("client read %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client read still held after the target identified")
+	}
+
+	// A held read ends with the tunnel.
+	held := &sshGuard{IReaderWithTimeout: readerWithTimeout{strings.NewReader("x")}, fail: fail,
+		after: &sshGuard{ready: make(chan struct{})}, ctx: ctx, ready: make(chan struct{})}
+	cancel()
+	if n, err := held.Read(b); n != 0 || err != context.Canceled {
+		t.Errorf("held Read after cancel = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,183 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// TargetsConfig is a catalog of named targets. Browsers open tunnels to
+// them by name on /ws/alias/{name}, so their addresses never show up in a
+// URL, and list them on GET /targets.
+type TargetsConfig struct {
+	// AllowAddresses keeps tunnels to addresses named by the browser
+	// working next to the catalog. Once a catalog is configured only its
+	// targets are dialed otherwise.
+	AllowAddresses bool           `yaml:"allow_addresses"`
+	Catalog        []TargetConfig `yaml:"catalog"`
+}
+
+// TargetConfig is one named target. The catalog is the operator's own
+// allow list, the destination policy and the blocked ranges do not apply to
+// its targets.
+type TargetConfig struct {
+	// Name is what browsers ask for, letters, digits, '.', '_' and '-'.
+	Name        string `yaml:"name"`
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	Description string `yaml:"description"`
+	// Via names the upstream to dial through, empty or "direct" dials
+	// directly. The via of the policy does not apply.
+	Via string `yaml:"via"`
+	// DialTimeout bounds the dial below the default of 30s.
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+	// Protocol is "any" or "ssh", the protocol of the policy when empty.
+	Protocol string `yaml:"protocol"`
+	// ProxyProtocol is "v1", "v2" or "none", the proxy_protocol of the
+	// policy when empty.
+	ProxyProtocol string `yaml:"proxy_protocol"`
+}
+
+var targetName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Catalog is a compiled TargetsConfig.
+type Catalog struct {
+	targets        []*Target
+	byName         map[string]*Target
+	allowAddresses bool
+}
+
+// Target is a compiled TargetConfig.
+type Target struct {
+	Name        string
+	Description string
+	Host        string
+	Port        int
+	dialTimeout time.Duration
+	// policy allows every address and routes through the target's
+	// upstream, so dialing it reuses the policy checked dialers, and
+	// carries its protocol and PROXY protocol version.
+	policy *Policy
+}
+
+// NewCatalog builds the catalog of cfg, nil when it lists no target. Every
+// upstream a target names must be one of upstreams, targets without a
+// protocol or PROXY protocol version take the one of policy.
+func NewCatalog(cfg TargetsConfig, policy *Policy, upstreams *Upstreams) (*Catalog, error) {
+	if len(cfg.Catalog) == 0 {
+		return nil, nil
+	}
+	c := &Catalog{byName: make(map[string]*Target), allowAddresses: cfg.AllowAddresses}
+	for i, tc := range cfg.Catalog {
+		switch {
+		case !targetName.MatchString(tc.Name):
+			return nil, fmt.Errorf("targets.catalog[%d]: invalid name %q", i, tc.Name)
+		case c.byName[tc.Name] != nil:
+			return nil, fmt.Errorf("targets.catalog[%d]: duplicate name %q", i, tc.Name)
+		case len(tc.Host) == 0:
+			return nil, fmt.Errorf("targets.catalog[%d]: host must be set", i)
+		case tc.Port < 1 || tc.Port > 65535:
+			return nil, fmt.Errorf("targets.catalog[%d]: port must be between 1 and 65535", i)
+		case tc.DialTimeout < 0 || tc.DialTimeout > dialTimeout:
+			return nil, fmt.Errorf("targets.catalog[%d]: dial_timeout must be between 0 and %s", i, dialTimeout)
+		}
+		if _, err := parseProtocol(tc.Protocol); err != nil {
+			return nil, fmt.Errorf("targets.catalog[%d]: protocol: %w", i, err)
+		}
+		if _, err := parseProxyProtocol(tc.ProxyProtocol); err != nil {
+			return nil, fmt.Errorf("targets.catalog[%d]: proxy_protocol: %w", i, err)
+		}
+		if len(tc.Via) != 0 && tc.Via != directUpstream {
+			if _, ok := upstreams.get(tc.Via); !ok {
+				return nil, fmt.Errorf("targets.catalog[%d]: unknown upstream %q", i, tc.Via)
+			}
+		}
+		protocol := tc.Protocol
+		if len(protocol) == 0 && policy != nil && policy.requireSSH {
+			protocol = ProtocolSSH
+		}
+		proxyProtocol := tc.ProxyProtocol
+		if len(proxyProtocol) == 0 && policy != nil {
+			proxyProtocol = policy.proxyProtocol
+		}
+		tp, err := NewPolicy(PolicyConfig{
+			Default:       PolicyAllow,
+			Via:           tc.Via,
+			Protocol:      protocol,
+			ProxyProtocol: proxyProtocol,
+			Rules: []RuleConfig{{
+				Action: PolicyAllow,
+				CIDRs:  []string{"0.0.0.0/0", "::/0"},
+			}},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("targets.catalog[%d]: %w", i, err)
+		}
+		t := &Target{
+			Name:        tc.Name,
+			Description: tc.Description,
+			Host:        tc.Host,
+			Port:        tc.Port,
+			dialTimeout: tc.DialTimeout,
+			policy:      tp,
+		}
+		c.targets = append(c.targets, t)
+		c.byName[t.Name] = t
+	}
+	return c, nil
+}
+
+// Lookup returns the target called name.
+func (c *Catalog) Lookup(name string) (*Target, bool) {
+	if c == nil {
+		return nil, false
+	}
+	t, ok := c.byName[name]
+	return t, ok
+}
+
+// exclusive reports whether only catalog targets may be dialed.
+func (c *Catalog) exclusive() bool {
+	return c != nil && !c.allowAddresses
+}
+
+// dialTarget connects to target through its upstream, if any.
+func (st *Settings) dialTarget(ctx context.Context, target *Target) (net.Conn, error) {
+	if target.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, target.dialTimeout)
+		defer cancel()
+	}
+	return st.dialPolicy(ctx, target.policy, target.Host, target.Port)
+}
+
+// TargetInfo is how GET /targets lists a target, without its address.
+type TargetInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// targetsHandler serves GET /targets, the catalog for the page to offer.
+func (s *WsToTcpServer) targetsHandler(w http.ResponseWriter, r *http.Request) {
+	c := s.current().Targets
+	targets := []TargetInfo{}
+	if c != nil {
+		for _, t := range c.targets {
+			targets = append(targets, TargetInfo{Name: t.Name, Description: t.Description})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	// allow_addresses tells the page whether to offer a free form host too.
+	json.NewEncoder(w).Encode(struct {
+		Targets        []TargetInfo `json:"targets"`
+		AllowAddresses bool         `json:"allow_addresses"`
+	}{targets, !c.exclusive()})
+}
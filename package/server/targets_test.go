@@ -0,0 +1,124 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNewCatalog(t *testing.T) {
+	c, err := NewCatalog(TargetsConfig{Catalog: []TargetConfig{{Name: "db-1", Host: "db.internal", Port: 22}}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, ok := c.Lookup("db-1"); !ok || target.Host != "db.internal" || target.Port != 22 {
+		t.Errorf("Lookup(db-1) = %+v, %v", target, ok)
+	}
+	if _, ok := c.Lookup("db-2"); ok {
+		t.Error("Lookup of an unknown name succeeded")
+	}
+	if !c.exclusive() {
+		t.Error("catalog without allow_addresses is not exclusive")
+	}
+	var none *Catalog
+	if _, ok := none.Lookup("db-1"); ok || none.exclusive() {
+		t.Error("nil catalog has targets")
+	}
+
+	for _, tc := range [][]TargetConfig{
+		{{Name: "db/1", Host: "db", Port: 22}},
+		{{Name: "db", Host: "db", Port: 22}, {Name: "db", Host: "db2", Port: 22}},
+		{{Name: "db", Port: 22}},
+		{{Name: "db", Host: "db", Port: 0}},
+		{{Name: "db", Host: "db", Port: 22, DialTimeout: time.Hour}},
+		{{Name: "db", Host: "db", Port: 22, Protocol: "telnet"}},
+		{{Name: "db", Host: "db", Port: 22, Via: "bastion"}},
+	} {
+		if _, err := NewCatalog(TargetsConfig{Catalog: tc}, nil, nil); err == nil {
+			t.Errorf("NewCatalog(%+v) succeeded, want an error", tc)
+		}
+	}
+}
+
+// catalogTestServer serves a catalog with the echo target at port.
+func catalogTestServer(t *testing.T, port int) string {
+	t.Helper()
+	_, url := newTestServer(t, &Config{Targets: TargetsConfig{Catalog: []TargetConfig{{Name: "echo", Host: "127.0.0.1", Port: port}}}})
+	return url
+}
+
+func TestAliasTunnel(t *testing.T) {
+	port := muxTestTarget(t, func(c net.Conn) { io.Copy(c, c) })
+	url := catalogTestServer(t, port)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/alias/echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTunnel(t, conn)
+
+	for path, status := range map[string]int{
+		"/ws/alias/unknown": http.StatusNotFound,
+		// Only the catalog is dialed without allow_addresses.
+		fmt.Sprintf("/ws/127.0.0.1/%d", port): StatusPolicyDenied,
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(url+path, nil)
+		if err == nil {
+			conn.Close()
+		}
+		if resp == nil || resp.StatusCode != status {
+			t.Errorf("%s: %v, want status %d", path, err, status)
+		}
+	}
+}
+
+func TestMuxTarget(t *testing.T) {
+	port := muxTestTarget(t, func(c net.Conn) { io.Copy(c, c) })
+	conn := dialMux(t, catalogTestServer(t, port))
+
+	open, _ := json.Marshal(muxOpenRequest{Target: "echo"})
+	sendMuxFrame(t, conn, muxOpen, 1, open)
+	if f, err := readMuxFrame(conn, 5*time.Second); err != nil || f.typ != muxOpened || f.id != 1 {
+		t.Fatalf("open of a catalog target answered with %+v, %v", f, err)
+	}
+	sendMuxFrame(t, conn, muxData, 1, []byte("ping"))
+	if f, err := readMuxFrame(conn, 5*time.Second); err != nil || f.typ != muxData || string(f.payload) != "ping" {
+		t.Errorf("echo: %+v, %v", f, err)
+	}
+
+	open, _ = json.Marshal(muxOpenRequest{Target: "unknown"})
+	sendMuxFrame(t, conn, muxOpen, 3, open)
+	var msg ControlMessage
+	for {
+		f, err := readMuxFrame(conn, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.id != 3 {
+			continue
+		}
+		if f.typ == muxError {
+			json.Unmarshal(f.payload, &msg)
+		}
+		if f.typ == muxClose {
+			if code := binary.BigEndian.Uint16(f.payload); code != uint16(refusedCloseCode(http.StatusNotFound)) {
+				t.Errorf("unknown target closed with %d", code)
+			}
+			break
+		}
+	}
+	if msg.Code != ErrCodeUnknownTarget {
+		t.Errorf("unknown target refused with %+v", msg)
+	}
+}
@@ -0,0 +1,373 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ticketVersion    = "v1"
+	defaultTicketTTL = time.Minute
+	minHMACKeySize   = 32
+)
+
+// TicketConfig enables signed connection tickets. Exactly one key must be
+// set. With only an Ed25519 public key the server verifies tickets issued
+// elsewhere and does not serve the issuing endpoint.
+//
+// Tickets are not single use: until it expires a ticket opens any number of
+// tunnels to its host and port, from anywhere, also on other servers that
+// share the key. TTL bounds that replay window. Tickets travel in the
+// ticket query parameter, so keep them out of access logs of proxies in
+// front of the server.
+type TicketConfig struct {
+	HMACKeyFile          string `yaml:"hmac_key_file"`
+	Ed25519KeyFile       string `yaml:"ed25519_key_file"`
+	Ed25519PublicKeyFile string `yaml:"ed25519_public_key_file"`
+	// TTL is how long tickets are valid, one minute when zero.
+	TTL time.Duration `yaml:"ttl"`
+	// Users may request tickets from POST /ticket with their bearer token.
+	Users []TicketUser `yaml:"users"`
+}
+
+// TicketUser is a user that authenticates with a bearer token, given inline
+// or read from TokenFile.
+type TicketUser struct {
+	ID        string `yaml:"id"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+}
+
+// Enabled reports whether any ticket key is configured.
+func (c *TicketConfig) Enabled() bool {
+	return c.HMACKeyFile != "" || c.Ed25519KeyFile != "" || c.Ed25519PublicKeyFile != ""
+}
+
+// TicketClaims is the signed content of a ticket.
+type TicketClaims struct {
+	User   string `json:"sub"`
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	Expiry int64  `json:"exp"`
+}
+
+type ticketSigner interface {
+	sign(payload []byte) ([]byte, bool)
+	verify(payload, sig []byte) bool
+}
+
+type hmacSigner []byte
+
+func (k hmacSigner) sign(payload []byte) ([]byte, bool) {
+	mac := hmac.New(sha256.New, k)
+	mac.Write(payload)
+	return mac.Sum(nil), true
+}
+
+func (k hmacSigner) verify(payload, sig []byte) bool {
+	expected, _ := k.sign(payload)
+	return hmac.Equal(expected, sig)
+}
+
+type ed25519Signer struct {
+	priv ed25519.PrivateKey // nil in verify-only mode
+	pub  ed25519.PublicKey
+}
+
+func (k ed25519Signer) sign(payload []byte) ([]byte, bool) {
+	if k.priv == nil {
+		return nil, false
+	}
+	return ed25519.Sign(k.priv, payload), true
+}
+
+func (k ed25519Signer) verify(payload, sig []byte) bool {
+	return ed25519.Verify(k.pub, payload, sig)
+}
+
+// Tickets issues and verifies short-lived connection tickets bound to a
+// user, a target and an expiry.
+type Tickets struct {
+	signer ticketSigner
+	ttl    time.Duration
+	users  bearerUsers
+}
+
+type ticketUser struct {
+	id    string
+	token []byte
+}
+
+// bearerUsers authenticates requests by their bearer token.
+type bearerUsers []ticketUser
+
+// loadBearerUsers reads the tokens of users, section prefixes errors.
+func loadBearerUsers(section string, users []TicketUser) (bearerUsers, error) {
+	var loaded bearerUsers
+	for i, u := range users {
+		token := []byte(u.Token)
+		if u.TokenFile != "" {
+			var err error
+			if token, err = os.ReadFile(u.TokenFile); err != nil {
+				return nil, fmt.Errorf("%s[%d]: %w", section, i, err)
+			}
+			token = bytes.TrimSpace(token)
+		}
+		if u.ID == "" || len(token) == 0 {
+			return nil, fmt.Errorf("%s[%d]: id and token are required", section, i)
+		}
+		loaded = append(loaded, ticketUser{id: u.ID, token: token})
+	}
+	return loaded, nil
+}
+
+func (users bearerUsers) authenticate(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || len(token) == 0 {
+		return "", false
+	}
+	for _, u := range users {
+		if subtle.ConstantTimeCompare(u.token, []byte(token)) == 1 {
+			return u.id, true
+		}
+	}
+	return "", false
+}
+
+// NewTickets loads the keys and tokens referenced by cfg.
+func NewTickets(cfg TicketConfig) (*Tickets, error) {
+	t := &Tickets{ttl: cfg.TTL}
+	if t.ttl <= 0 {
+		t.ttl = defaultTicketTTL
+	}
+	var err error
+	switch {
+	case cfg.HMACKeyFile != "" && cfg.Ed25519KeyFile == "" && cfg.Ed25519PublicKeyFile == "":
+		t.signer, err = loadHMACKey(cfg.HMACKeyFile)
+	case cfg.Ed25519KeyFile != "" && cfg.HMACKeyFile == "" && cfg.Ed25519PublicKeyFile == "":
+		t.signer, err = loadEd25519Key(cfg.Ed25519KeyFile)
+	case cfg.Ed25519PublicKeyFile != "" && cfg.HMACKeyFile == "" && cfg.Ed25519KeyFile == "":
+		t.signer, err = loadEd25519PublicKey(cfg.Ed25519PublicKeyFile)
+	default:
+		return nil, errors.New("tickets: exactly one of hmac_key_file, ed25519_key_file and ed25519_public_key_file must be set")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tickets: %w", err)
+	}
+	if t.users, err = loadBearerUsers("tickets.users", cfg.Users); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func loadHMACKey(path string) (ticketSigner, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < minHMACKeySize {
+		return nil, fmt.Errorf("%s: HMAC key must be at least %d bytes", path, minHMACKeySize)
+	}
+	return hmacSigner(key), nil
+}
+
+func readPEM(path, kind string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != kind {
+		return nil, fmt.Errorf("%s: no %q PEM block", path, kind)
+	}
+	return block.Bytes, nil
+}
+
+func loadEd25519Key(path string) (ticketSigner, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return ed25519Signer{priv: priv, pub: priv.Public().(ed25519.PublicKey)}, nil
+}
+
+func loadEd25519PublicKey(path string) (ticketSigner, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return ed25519Signer{pub: pub}, nil
+}
+
+// CanIssue reports whether the configured key can sign new tickets.
+func (t *Tickets) CanIssue() bool {
+	_, ok := t.signer.sign(nil)
+	return ok
+}
+
+// Issue signs a ticket for user to reach host:port.
+func (t *Tickets) Issue(user, host string, port int) (string, time.Time, error) {
+	expiry := time.Now().Add(t.ttl)
+	payload, err := json.Marshal(TicketClaims{
+		User:   user,
+		Host:   strings.ToLower(host),
+		Port:   port,
+		Expiry: expiry.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	sig, ok := t.signer.sign(payload)
+	if !ok {
+		return "", time.Time{}, errors.New("ticket key can only verify")
+	}
+	enc := base64.RawURLEncoding
+	return ticketVersion + "." + enc.EncodeToString(payload) + "." + enc.EncodeToString(sig), expiry, nil
+}
+
+// Verify checks the signature and expiry of ticket and that it was issued
+// for host:port.
+func (t *Tickets) Verify(ticket, host string, port int) (*TicketClaims, error) {
+	if len(ticket) == 0 {
+		return nil, errors.New("missing ticket")
+	}
+	parts := strings.Split(ticket, ".")
+	if len(parts) != 3 || parts[0] != ticketVersion {
+		return nil, errors.New("malformed ticket")
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed ticket")
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed ticket")
+	}
+	if !t.signer.verify(payload, sig) {
+		return nil, errors.New("bad ticket signature")
+	}
+	claims := &TicketClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, errors.New("malformed ticket")
+	}
+	if time.Now().Unix() >= claims.Expiry {
+		return nil, fmt.Errorf("ticket of %s expired", claims.User)
+	}
+	if !strings.EqualFold(claims.Host, host) || claims.Port != port {
+		return nil, fmt.Errorf("ticket of %s is for %s:%d", claims.User, claims.Host, claims.Port)
+	}
+	return claims, nil
+}
+
+// ticketRequest names a catalog target or host and port.
+type ticketRequest struct {
+	Target string `json:"target"`
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+}
+
+type ticketResponse struct {
+	Ticket  string    `json:"ticket"`
+	Expires time.Time `json:"expires"`
+}
+
+// ticketHandler serves POST /ticket. The caller authenticates with a bearer
+// token and names the target either as a JSON body or as target or
+// host/port form values. Tickets for a catalog target are issued for its
+// address.
+func (s *WsToTcpServer) ticketHandler(w http.ResponseWriter, r *http.Request) {
+	// One snapshot, so a reload can't mix the users of one config with the
+	// catalog and policy of another.
+	st := s.current()
+	tickets := st.Tickets
+	if tickets == nil || !tickets.CanIssue() {
+		http.NotFound(w, r)
+		return
+	}
+	user, ok := tickets.users.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gowasmssh"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req ticketRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.Target = r.FormValue("target")
+		req.Host = r.FormValue("host")
+		req.Port, _ = strconv.Atoi(r.FormValue("port"))
+	}
+	if len(req.Target) != 0 {
+		target, ok := st.Targets.Lookup(req.Target)
+		if !ok {
+			http.Error(w, "unknown target", http.StatusNotFound)
+			return
+		}
+		req.Host, req.Port = target.Host, target.Port
+	} else {
+		req.Host = strings.Trim(req.Host, "[]")
+		if len(req.Host) == 0 || req.Port < 1 || req.Port > 65535 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		addr := net.JoinHostPort(req.Host, strconv.Itoa(req.Port))
+		if st.Targets.exclusive() {
+			s.logger().Warn("denied ticket", "target", addr, "user", user, "error", "not in the target catalog")
+			http.Error(w, "destination not allowed", StatusPolicyDenied)
+			return
+		}
+		if decision := st.policy().Evaluate(req.Host, req.Port); !decision.Allow {
+			s.logger().Warn("denied ticket", "target", addr, "user", user, "rule", decision.String())
+			http.Error(w, "destination not allowed", StatusPolicyDenied)
+			return
+		}
+	}
+	ticket, expires, err := tickets.Issue(user, req.Host, req.Port)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(ticketResponse{Ticket: ticket, Expires: expires})
+}
@@ -0,0 +1,166 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTicketsIssueVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signers := map[string]ticketSigner{
+		"hmac":    hmacSigner(bytes.Repeat([]byte("k"), minHMACKeySize)),
+		"ed25519": ed25519Signer{priv: priv, pub: pub},
+	}
+	for name, signer := range signers {
+		tickets := &Tickets{signer: signer, ttl: time.Minute}
+		ticket, expiry, err := tickets.Issue("alice", "Build.Example.com", 22)
+		if err != nil {
+			t.Fatalf("%s: Issue: %v", name, err)
+		}
+		if d := time.Until(expiry); d <= 0 || d > time.Minute {
+			t.Errorf("%s: expiry in %v, want within a minute", name, d)
+		}
+		claims, err := tickets.Verify(ticket, "build.example.com", 22)
+		if err != nil {
+			t.Fatalf("%s: Verify: %v", name, err)
+		}
+		if claims.User != "alice" || claims.Host != "build.example.com" || claims.Port != 22 {
+			t.Errorf("%s: claims = %+v", name, claims)
+		}
+
+		parts := strings.Split(ticket, ".")
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString(bytes.Replace(payload, []byte(`"port":22`), []byte(`"port":23`), 1)) + "." + parts[2]
+		tests := []struct {
+			ticket, host string
+			port         int
+		}{
+			{"", "build.example.com", 22},
+			{ticket, "other.example.com", 22},
+			{ticket, "build.example.com", 2222},
+			{forged, "build.example.com", 23},
+			{"v2." + parts[1] + "." + parts[2], "build.example.com", 22},
+			{parts[0] + "." + parts[1], "build.example.com", 22},
+			{parts[0] + "." + parts[1] + "." + parts[2] + ".x", "build.example.com", 22},
+			{parts[0] + ".!!." + parts[2], "build.example.com", 22},
+			{parts[0] + "." + parts[1] + ".!!", "build.example.com", 22},
+			{parts[0] + "." + parts[1] + ".", "build.example.com", 22},
+		}
+		for _, tt := range tests {
+			if _, err := tickets.Verify(tt.ticket, tt.host, tt.port); err == nil {
+				t.Errorf("%s: Verify(%q, %s, %d) succeeded, want an error", name, tt.ticket, tt.host, tt.port)
+			}
+		}
+	}
+}
+
+func TestTicketsRejectForeignAndExpired(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), minHMACKeySize)
+	other := &Tickets{signer: hmacSigner(bytes.Repeat([]byte("o"), minHMACKeySize)), ttl: time.Minute}
+	ticket, _, err := other.Issue("alice", "10.0.0.1", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tickets := &Tickets{signer: hmacSigner(key), ttl: time.Minute}
+	if _, err := tickets.Verify(ticket, "10.0.0.1", 22); err == nil {
+		t.Error("ticket signed with another key verified")
+	}
+
+	expired := &Tickets{signer: hmacSigner(key), ttl: -time.Second}
+	ticket, _, err = expired.Issue("alice", "10.0.0.1", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tickets.Verify(ticket, "10.0.0.1", 22); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Verify of an expired ticket = %v, want expired", err)
+	}
+}
+
+func TestNewTickets(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacKey := writeTestFile(t, "hmac.key", append(bytes.Repeat([]byte("k"), minHMACKeySize), '\n'))
+	shortKey := writeTestFile(t, "short.key", []byte("too short"))
+	privKey := writeTestFile(t, "ed25519.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}))
+	pubKey := writeTestFile(t, "ed25519.pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+
+	tests := []struct {
+		cfg      TicketConfig
+		ok       bool
+		canIssue bool
+	}{
+		{TicketConfig{HMACKeyFile: hmacKey}, true, true},
+		{TicketConfig{Ed25519KeyFile: privKey}, true, true},
+		{TicketConfig{Ed25519PublicKeyFile: pubKey}, true, false},
+		{TicketConfig{HMACKeyFile: shortKey}, false, false},
+		{TicketConfig{HMACKeyFile: hmacKey, Ed25519KeyFile: privKey}, false, false},
+		{TicketConfig{Ed25519KeyFile: pubKey}, false, false},
+		{TicketConfig{Ed25519PublicKeyFile: privKey}, false, false},
+		{TicketConfig{HMACKeyFile: hmacKey, Users: []TicketUser{{ID: "alice"}}}, false, false},
+		{TicketConfig{}, false, false},
+	}
+	for i, tt := range tests {
+		tickets, err := NewTickets(tt.cfg)
+		if (err == nil) != tt.ok {
+			t.Errorf("%d: NewTickets = %v, want ok %v", i, err, tt.ok)
+			continue
+		}
+		if err == nil && tickets.CanIssue() != tt.canIssue {
+			t.Errorf("%d: CanIssue = %v, want %v", i, tickets.CanIssue(), tt.canIssue)
+		}
+	}
+
+	// A public key verifies what its private key issued.
+	issuer, err := NewTickets(TicketConfig{Ed25519KeyFile: privKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewTickets(TicketConfig{Ed25519PublicKeyFile: pubKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket, _, err := issuer.Issue("alice", "10.0.0.1", 22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(ticket, "10.0.0.1", 22); err != nil {
+		t.Errorf("Verify with the public key: %v", err)
+	}
+	if _, _, err := verifier.Issue("alice", "10.0.0.1", 22); err == nil {
+		t.Error("Issue with only a public key succeeded")
+	}
+}
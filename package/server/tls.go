@@ -0,0 +1,182 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsCheckInterval bounds how often the certificate files are stat'ed for
+// changes during handshakes.
+const tlsCheckInterval = 5 * time.Second
+
+// TLSConfig enables HTTPS on the main listener.
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ClientCA is a PEM bundle; when set clients must present a certificate
+	// signed by one of its CAs.
+	ClientCA string `yaml:"client_ca"`
+	// ClientAuth is "require" (default) or "optional", which verifies a
+	// client certificate only when one is presented.
+	ClientAuth string `yaml:"client_auth"`
+}
+
+// Enabled reports whether a certificate is configured.
+func (c *TLSConfig) Enabled() bool {
+	return c.Cert != "" || c.Key != ""
+}
+
+// CertReloader serves the certificate, key and client CA bundle of a
+// TLSConfig and picks up changes to the files without a restart.
+type CertReloader struct {
+	cfg        TLSConfig
+	clientAuth tls.ClientAuthType
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  [3]time.Time
+	lastCheck time.Time
+}
+
+func NewCertReloader(cfg TLSConfig) (*CertReloader, error) {
+	if cfg.Cert == "" || cfg.Key == "" {
+		return nil, errors.New("tls: both cert and key are required")
+	}
+	r := &CertReloader{cfg: cfg}
+	if cfg.ClientCA != "" {
+		// Certificates are verified against the current bundle in
+		// verifyClient, crypto/tls only asks for them.
+		switch cfg.ClientAuth {
+		case "", "require":
+			r.clientAuth = tls.RequireAnyClientCert
+		case "optional":
+			r.clientAuth = tls.RequestClientCert
+		default:
+			return nil, fmt.Errorf("tls.client_auth: unknown mode %q", cfg.ClientAuth)
+		}
+	} else if cfg.ClientAuth != "" {
+		return nil, errors.New("tls.client_auth: requires client_ca")
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. On error the previous certificate stays in
+// use.
+func (r *CertReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.load()
+}
+
+func (r *CertReloader) load() error {
+	var modTimes [3]time.Time
+	for i, path := range []string{r.cfg.Cert, r.cfg.Key, r.cfg.ClientCA} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		modTimes[i] = fi.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.cfg.Cert, r.cfg.Key)
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.cfg.ClientCA != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCA)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls: no certificates in %s", r.cfg.ClientCA)
+		}
+	}
+	r.cert, r.clientCAs, r.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+// current reloads the files when they changed since the last load.
+func (r *CertReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.lastCheck) >= tlsCheckInterval {
+		r.lastCheck = now
+		if r.changed() {
+			// A half-written file fails to load and is retried on the next
+			// check, the old certificate keeps serving meanwhile.
+			r.load()
+		}
+	}
+	return r.cert, r.clientCAs
+}
+
+func (r *CertReloader) changed() bool {
+	for i, path := range []string{r.cfg.Cert, r.cfg.Key, r.cfg.ClientCA} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err == nil && !fi.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSConfig returns a tls.Config that always uses the latest files. It is
+// shared by all handshakes, so session tickets stay valid across them, and
+// offers only HTTP/1.1, which WebSocket upgrades need.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+	if r.clientAuth != tls.NoClientCert {
+		cfg.ClientAuth = r.clientAuth
+		cfg.VerifyConnection = r.verifyClient
+	}
+	return cfg
+}
+
+// verifyClient verifies the client certificate, if any, against the latest
+// client CA bundle. It also runs on resumed sessions, so a certificate
+// whose CA was removed stops working at once.
+func (r *CertReloader) verifyClient(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		// A missing certificate was refused already when one is required.
+		return nil
+	}
+	_, clientCAs := r.current()
+	opts := x509.VerifyOptions{
+		Roots:         clientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		return fmt.Errorf("tls: client certificate: %w", err)
+	}
+	return nil
+}
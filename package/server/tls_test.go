@@ -0,0 +1,151 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate for name, self-signed when parent is nil.
+func testCert(t *testing.T, name string, parent *tls.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	issuer, signer := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func certPEM(cert tls.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+}
+
+func keyPEM(t *testing.T, cert tls.Certificate) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// tlsHandshake runs one handshake against server and returns the client's
+// view of it.
+func tlsHandshake(t *testing.T, server, client *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+	serverConn, clientConn := tcpPipe(t)
+	defer clientConn.Close()
+	done := make(chan error, 1)
+	go func() {
+		defer serverConn.Close()
+		conn := tls.Server(serverConn, server)
+		err := conn.Handshake()
+		if err == nil {
+			// A TLS 1.3 client reports a refused certificate, and gets its
+			// session ticket, on its first read.
+			_, err = conn.Write([]byte{1})
+		}
+		done <- err
+	}()
+	conn := tls.Client(clientConn, client)
+	err := conn.Handshake()
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	}
+	if serverErr := <-done; err == nil {
+		err = serverErr
+	}
+	return conn.ConnectionState(), err
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := testCert(t, "ca", nil, x509.ExtKeyUsageAny)
+	other := testCert(t, "other", nil, x509.ExtKeyUsageAny)
+	serverCert := testCert(t, "gateway.test", &ca, x509.ExtKeyUsageServerAuth)
+	clientCert := testCert(t, "client", &ca, x509.ExtKeyUsageClientAuth)
+	strangerCert := testCert(t, "stranger", &other, x509.ExtKeyUsageClientAuth)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	cfg := TLSConfig{
+		Cert:     writeTestFile(t, "cert.pem", certPEM(serverCert)),
+		Key:      writeTestFile(t, "key.pem", keyPEM(t, serverCert)),
+		ClientCA: writeTestFile(t, "ca.pem", certPEM(ca)),
+	}
+	client := func(certs ...tls.Certificate) *tls.Config {
+		return &tls.Config{
+			RootCAs:            roots,
+			ServerName:         "gateway.test",
+			Certificates:       certs,
+			NextProtos:         []string{"h2", "http/1.1"},
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		}
+	}
+
+	r, err := NewCertReloader(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := r.TLSConfig()
+	known := client(clientCert)
+	state, err := tlsHandshake(t, server, known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.NegotiatedProtocol != "http/1.1" {
+		t.Errorf("negotiated %q, want http/1.1", state.NegotiatedProtocol)
+	}
+	if state, err = tlsHandshake(t, server, known); err != nil || !state.DidResume {
+		t.Errorf("second handshake: resumed %v, %v", state.DidResume, err)
+	}
+	if _, err := tlsHandshake(t, server, client(strangerCert)); err == nil {
+		t.Error("certificate of an unknown CA accepted")
+	}
+	if _, err := tlsHandshake(t, server, client()); err == nil {
+		t.Error("handshake without a certificate accepted")
+	}
+
+	cfg.ClientAuth = "optional"
+	if r, err = NewCertReloader(cfg); err != nil {
+		t.Fatal(err)
+	}
+	server = r.TLSConfig()
+	if _, err := tlsHandshake(t, server, client()); err != nil {
+		t.Errorf("optional, without a certificate: %v", err)
+	}
+	if _, err := tlsHandshake(t, server, client(strangerCert)); err == nil {
+		t.Error("optional, certificate of an unknown CA accepted")
+	}
+}
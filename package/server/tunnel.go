@@ -0,0 +1,285 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Application close codes sent to the browser when the server ends a tunnel.
+const (
+	CloseGoingAway   = 1001
+	CloseIdleTimeout = 4001
+	CloseMaxLifetime = 4002
+	CloseTerminated  = 4003
+)
+
+// tunnel holds what is known about one browser to target connection.
+type tunnel struct {
+	id       string
+	clientIP string
+	// clientAddr is the browser's address and port, invalid when the
+	// request came over a Unix socket.
+	clientAddr netip.AddrPort
+	origin     string
+	user       string
+	// clientCert is the subject of the verified TLS client certificate.
+	clientCert string
+	host       string
+	port       int
+	// target is the catalog entry the tunnel was opened by name to.
+	target *Target
+	// settings are the Settings the tunnel was admitted with.
+	settings *Settings
+	// conn is the browser end, set before the tunnel is registered.
+	conn clientSide
+
+	// mu guards what is learned from the dial, the admin API reads it
+	// while the tunnel is open.
+	mu         sync.Mutex
+	resolvedIP string
+	// upstream is the proxy the target was dialed through, if any.
+	upstream string
+	// hostKey is the SHA256 fingerprint of the SSH host key the target
+	// presented, when host keys are tracked.
+	hostKey string
+	// cancel tears the tunnel down.
+	cancel   context.CancelFunc
+	start    time.Time
+	end      time.Time
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	// lastActivity is the UnixNano time bytes last moved in either direction.
+	lastActivity atomic.Int64
+
+	reasonOnce  sync.Once
+	closeReason string
+	// closeCode is sent to the browser in the close frame when non-zero.
+	closeCode int
+}
+
+func newTunnel(r *http.Request, st *Settings, host string, port int) *tunnel {
+	var id [8]byte
+	rand.Read(id[:])
+	t := &tunnel{
+		id:       hex.EncodeToString(id[:]),
+		clientIP: clientIP(r),
+		origin:   r.Header.Get("Origin"),
+		host:     host,
+		port:     port,
+		settings: st,
+	}
+	if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		t.clientAddr = addr
+	}
+	// Client certificates are verified during the handshake, see
+	// CertReloader.verifyClient.
+	if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+		t.clientCert = r.TLS.PeerCertificates[0].Subject.String()
+	}
+	return t
+}
+
+// setCloseReason records why the tunnel ended, only the first reason sticks.
+func (t *tunnel) setCloseReason(reason string) {
+	t.closeWith(0, reason)
+}
+
+// closeWith is setCloseReason with a WebSocket close code for the browser.
+// It reports whether this call decided the reason.
+func (t *tunnel) closeWith(code int, reason string) bool {
+	decided := false
+	t.reasonOnce.Do(func() {
+		t.closeReason, t.closeCode = reason, code
+		decided = true
+	})
+	return decided
+}
+
+// dialed records where the target connection leads.
+func (t *tunnel) dialed(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		t.resolvedIP = addr.IP.String()
+	}
+	if pc, ok := conn.(*proxiedConn); ok {
+		t.upstream = pc.upstream
+	}
+}
+
+func (t *tunnel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// watch closes the tunnel once it has been idle for idleTimeout or open for
+// maxLifetime, zero disables either check.
+func (t *tunnel) watch(ctx context.Context, cancel context.CancelFunc, idleTimeout, maxLifetime time.Duration) {
+	var lifetime, idle <-chan time.Time
+	if maxLifetime > 0 {
+		timer := time.NewTimer(maxLifetime - time.Since(t.start))
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-lifetime:
+			t.closeWith(CloseMaxLifetime, fmt.Sprintf("session expired: maximum lifetime of %s reached", maxLifetime))
+			cancel()
+			return
+		case <-idle:
+			quiet := time.Since(time.Unix(0, t.lastActivity.Load()))
+			if quiet < idleTimeout {
+				idleTimer.Reset(idleTimeout - quiet)
+				continue
+			}
+			t.closeWith(CloseIdleTimeout, fmt.Sprintf("session expired: idle for %s", idleTimeout))
+			cancel()
+			return
+		}
+	}
+}
+
+// info returns the admin API view of the tunnel.
+func (t *tunnel) info() TunnelInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return TunnelInfo{
+		ID:         t.id,
+		ClientIP:   t.clientIP,
+		Origin:     t.origin,
+		User:       t.user,
+		ClientCert: t.clientCert,
+		TargetName: t.targetName(),
+		TargetHost: t.host,
+		TargetPort: t.port,
+		ResolvedIP: t.resolvedIP,
+		Upstream:   t.upstream,
+		HostKey:    t.hostKey,
+		Start:      t.start,
+		BytesIn:    t.bytesIn.Load(),
+		BytesOut:   t.bytesOut.Load(),
+	}
+}
+
+func (t *tunnel) targetName() string {
+	if t.target == nil {
+		return ""
+	}
+	return t.target.Name
+}
+
+// logAttrs returns the access log record of the tunnel.
+func (t *tunnel) logAttrs() []slog.Attr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return []slog.Attr{
+		slog.String("id", t.id),
+		slog.String("client_ip", t.clientIP),
+		slog.String("origin", t.origin),
+		slog.String("user", t.user),
+		slog.String("client_cert", t.clientCert),
+		slog.String("target_name", t.targetName()),
+		slog.String("target_host", t.host),
+		slog.Int("target_port", t.port),
+		slog.String("resolved_ip", t.resolvedIP),
+		slog.String("upstream", t.upstream),
+		slog.String("host_key", t.hostKey),
+		slog.Time("start", t.start),
+		slog.Time("end", t.end),
+		slog.Duration("duration", t.end.Sub(t.start)),
+		slog.Int64("bytes_in", t.bytesIn.Load()),
+		slog.Int64("bytes_out", t.bytesOut.Load()),
+		slog.String("close_reason", t.closeReason),
+	}
+}
+
+// clientIP returns the address of the peer that sent r, the client behind
+// a trusted proxy, see forwarded.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tunnelRegistry tracks the live tunnels, which http.Server cannot do for
+// hijacked connections.
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	tunnels map[string]*tunnel
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{tunnels: make(map[string]*tunnel)}
+}
+
+func (r *tunnelRegistry) add(t *tunnel) {
+	r.mu.Lock()
+	r.tunnels[t.id] = t
+	r.mu.Unlock()
+}
+
+func (r *tunnelRegistry) remove(t *tunnel) {
+	r.mu.Lock()
+	delete(r.tunnels, t.id)
+	r.mu.Unlock()
+}
+
+func (r *tunnelRegistry) get(id string) *tunnel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tunnels[id]
+}
+
+func (r *tunnelRegistry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.tunnels)
+}
+
+func (r *tunnelRegistry) list() []*tunnel {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*tunnel, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		list = append(list, t)
+	}
+	return list
+}
+
+// wait blocks until no tunnel is left or ctx is done, and reports whether
+// the registry emptied.
+func (r *tunnelRegistry) wait(ctx context.Context) bool {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for r.len() != 0 {
+		select {
+		case <-ctx.Done():
+			return r.len() == 0
+		case <-ticker.C:
+		}
+	}
+	return true
+}
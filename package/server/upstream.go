@@ -0,0 +1,346 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+
+	"golang.org/x/net/proxy"
+)
+
+// directUpstream is the upstream name that bypasses any policy wide
+// upstream.
+const directUpstream = "direct"
+
+// UpstreamConfig is a proxy targets can be dialed through, picked with the
+// via setting of the destination policy.
+type UpstreamConfig struct {
+	Name string `yaml:"name"`
+	// URL is socks5://host:port for SOCKS5, http://host:port or
+	// https://host:port for HTTP CONNECT and ssh://user@host:port for an
+	// SSH jump host. Credentials may be given as user:password@ in the URL.
+	URL string `yaml:"url"`
+	// PasswordFile replaces the password of the URL with the file content.
+	PasswordFile string `yaml:"password_file"`
+	// RemoteDNS hands hostnames to the proxy. By default they are resolved
+	// locally and every address is checked like a direct dial before the
+	// proxy is asked to connect to it. With RemoteDNS the server never sees
+	// the address: neither the blocked ranges nor CIDR rules apply to
+	// hostnames, a name resolving to 127.0.0.1 or 169.254.169.254 on the
+	// proxy's side is dialed. The proxy must enforce its own restrictions,
+	// and policies with CIDR rules can't route through such an upstream.
+	RemoteDNS bool `yaml:"remote_dns"`
+
+	// KeyFile is the private key the server logs in to an SSH jump host
+	// with, users never see it.
+	KeyFile string `yaml:"key_file"`
+	// HostKey pins the jump host key, as an authorized_keys line or a
+	// SHA256:... fingerprint. KnownHostsFile is the alternative, one of
+	// them is required.
+	HostKey        string `yaml:"host_key"`
+	KnownHostsFile string `yaml:"known_hosts"`
+}
+
+// UpstreamError is returned when an upstream proxy refused or failed to
+// connect to a target.
+type UpstreamError struct {
+	Upstream string
+	Err      error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream %s: %v", e.Upstream, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// Upstreams holds the configured upstream proxies by name.
+type Upstreams struct {
+	byName map[string]*upstream
+}
+
+type upstream struct {
+	cfg       UpstreamConfig
+	name      string
+	remoteDNS bool
+	dial      func(ctx context.Context, addr string) (net.Conn, error)
+	// retire releases what the upstream holds once its connections are
+	// closed, nil when there is nothing to release.
+	retire func()
+	// bastion is the jump host of ssh upstreams, nil for the others.
+	bastion *bastion
+}
+
+// NewUpstreams builds the upstreams of cfgs and checks that every upstream
+// policy refers to exists.
+func NewUpstreams(cfgs []UpstreamConfig, policy *Policy) (*Upstreams, error) {
+	u := &Upstreams{byName: make(map[string]*upstream)}
+	for i, cfg := range cfgs {
+		if len(cfg.Name) == 0 || cfg.Name == directUpstream {
+			return nil, fmt.Errorf("upstreams[%d]: name must be set and not %q", i, directUpstream)
+		}
+		if _, ok := u.byName[cfg.Name]; ok {
+			return nil, fmt.Errorf("upstreams[%d]: duplicate name %q", i, cfg.Name)
+		}
+		up, err := newUpstream(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("upstreams[%d]: %w", i, err)
+		}
+		u.byName[cfg.Name] = up
+	}
+	if policy != nil {
+		for _, name := range policy.upstreams() {
+			up, ok := u.byName[name]
+			if !ok {
+				return nil, fmt.Errorf("policy: unknown upstream %q", name)
+			}
+			if up.remoteDNS && policy.hasCIDRRules() {
+				return nil, fmt.Errorf("policy: upstream %q has remote_dns, which bypasses the cidrs rules of the policy", name)
+			}
+		}
+	}
+	return u, nil
+}
+
+func newUpstream(cfg UpstreamConfig) (*upstream, error) {
+	proxyURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("url: %w", err)
+	}
+	if len(proxyURL.Host) == 0 {
+		return nil, errors.New("url: missing host")
+	}
+	user, password := proxyURL.User.Username(), ""
+	if p, ok := proxyURL.User.Password(); ok {
+		password = p
+	}
+	if len(cfg.PasswordFile) != 0 {
+		data, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("password_file: %w", err)
+		}
+		password = string(bytes.TrimSpace(data))
+	}
+	// The proxy itself is configured by the operator, so it is dialed
+	// without the guard against private addresses.
+	forward := &net.Dialer{Timeout: dialTimeout}
+	up := &upstream{cfg: cfg, name: cfg.Name, remoteDNS: cfg.RemoteDNS}
+	switch proxyURL.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if len(user) != 0 {
+			auth = &proxy.Auth{User: user, Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, forward)
+		if err != nil {
+			return nil, err
+		}
+		up.dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+		}
+	case "http", "https":
+		var authorization string
+		if len(user) != 0 {
+			authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+		}
+		up.dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return httpConnect(ctx, forward, proxyURL, authorization, addr)
+		}
+	case "ssh":
+		b, err := newBastion(cfg.Name, proxyURL, password, cfg, forward)
+		if err != nil {
+			return nil, err
+		}
+		up.dial, up.retire, up.bastion = b.dial, b.retire, b
+	default:
+		return nil, fmt.Errorf("url: unsupported scheme %q, want socks5, http, https or ssh", proxyURL.Scheme)
+	}
+	return up, nil
+}
+
+func (u *Upstreams) get(name string) (*upstream, bool) {
+	if u == nil {
+		return nil, false
+	}
+	up, ok := u.byName[name]
+	return up, ok
+}
+
+// adopt takes over the upstreams of prev whose configuration did not
+// change, so a reload keeps their connections, and retires the others.
+func (u *Upstreams) adopt(prev *Upstreams) {
+	if prev == nil || prev == u {
+		return
+	}
+	for name, old := range prev.byName {
+		if up, ok := u.get(name); ok && up.cfg == old.cfg {
+			u.byName[name] = old
+		} else if old.retire != nil {
+			old.retire()
+		}
+	}
+}
+
+// setLogger makes the upstreams log to logger. It must be called before
+// they are used.
+func (u *Upstreams) setLogger(logger *slog.Logger) {
+	if u == nil {
+		return
+	}
+	for _, up := range u.byName {
+		if up.bastion != nil {
+			up.bastion.logger = logger
+		}
+	}
+}
+
+// httpConnect opens a tunnel to addr with an HTTP CONNECT request.
+func httpConnect(ctx context.Context, forward *net.Dialer, proxyURL *url.URL, authorization, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if len(proxyURL.Port()) == 0 {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), defaultPort(proxyURL.Scheme))
+	}
+	conn, err := forward.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if len(authorization) != 0 {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if br.Buffered() != 0 {
+		return &proxiedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// proxiedConn is a connection made through an upstream. It reports the
+// target, not the proxy, as its remote address.
+type proxiedConn struct {
+	net.Conn
+	// r holds bytes the proxy sent right after its handshake, nil for none.
+	r        io.Reader
+	upstream string
+	remote   net.Addr
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	if c.r != nil {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// unresolvedAddr is the remote address of a target resolved by the proxy.
+type unresolvedAddr string
+
+func (a unresolvedAddr) Network() string { return "tcp" }
+func (a unresolvedAddr) String() string  { return string(a) }
+
+// dialVia connects to host:port through upstream name. Unless the
+// upstream resolves names remotely, host is resolved here and every
+// address is checked against policy and the blocked ranges.
+func (u *Upstreams) dialVia(ctx context.Context, name string, policy *Policy, host string, port int) (net.Conn, error) {
+	up, ok := u.get(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown upstream %q", name)
+	}
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	wrap := func(conn net.Conn, remote net.Addr) net.Conn {
+		pc, ok := conn.(*proxiedConn)
+		if !ok {
+			pc = &proxiedConn{Conn: conn}
+		}
+		pc.upstream, pc.remote = up.name, remote
+		return pc
+	}
+	if up.remoteDNS {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		conn, err := up.dial(ctx, addr)
+		if err != nil {
+			return nil, &UpstreamError{Upstream: up.name, Err: err}
+		}
+		return wrap(conn, unresolvedAddr(addr)), nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, addr := range addrs {
+		ap := netip.AddrPortFrom(addr.Unmap(), uint16(port))
+		if err := checkAddr(policy, ap); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		conn, err := up.dial(ctx, ap.String())
+		if err != nil {
+			if firstErr == nil {
+				firstErr = &UpstreamError{Upstream: up.name, Err: err}
+			}
+			continue
+		}
+		return wrap(conn, net.TCPAddrFromAddrPort(ap)), nil
+	}
+	return nil, firstErr
+}
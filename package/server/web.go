@@ -0,0 +1,72 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// CleanBasePath normalizes the URL prefix the server is mounted under to
+// "/a/b" form, "" for the root.
+func CleanBasePath(p string) (string, error) {
+	if len(p) == 0 || p == "/" {
+		return "", nil
+	}
+	if strings.ContainsAny(p, "?#{}") {
+		return "", fmt.Errorf("base_path: %q must be a plain path", p)
+	}
+	clean := path.Clean("/" + strings.Trim(p, "/"))
+	// A prefix cleaned down to the root would register patterns starting
+	// with "//" and mount everything at / without a word.
+	if clean == "/" || slices.Contains(strings.Split(p, "/"), "..") {
+		return "", fmt.Errorf("base_path: %q must name a directory below /", p)
+	}
+	return clean, nil
+}
+
+// webFS returns the files of the web page: StaticDir when set, for working
+// on the page without rebuilding the binary, otherwise the embedded bundle.
+func (s *WsToTcpServer) webFS(staticFS embed.FS) (fs.FS, error) {
+	if len(s.StaticDir) != 0 {
+		if _, err := os.Stat(s.StaticDir); err != nil {
+			return nil, err
+		}
+		return os.DirFS(s.StaticDir), nil
+	}
+	return fs.Sub(staticFS, "webpage/dist")
+}
+
+// envScript serves env.js, which tells the page and the wasm client the base
+// path the server is mounted under. The page ships a default env.js for
+// deployments without this server.
+func (s *WsToTcpServer) envScript(w http.ResponseWriter, r *http.Request) {
+	base, _ := json.Marshal(s.BasePath)
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "window.gowasmsshBasePath = %s;\n", base)
+}
+
+// mount serves handler under BasePath. Probes stay reachable at the root
+// too, orchestrators check the pod directly rather than through the
+// ingress.
+func (s *WsToTcpServer) mount(handler http.Handler) http.Handler {
+	if len(s.BasePath) == 0 {
+		return handler
+	}
+	mux := http.NewServeMux()
+	mux.Handle(s.BasePath+"/", http.StripPrefix(s.BasePath, handler))
+	mux.Handle(s.BasePath, http.RedirectHandler(s.BasePath+"/", http.StatusMovedPermanently))
+	mux.HandleFunc("GET /healthz", s.healthz)
+	mux.HandleFunc("GET /readyz", s.readyz)
+	mux.HandleFunc("GET /version", s.version)
+	return mux
+}
@@ -0,0 +1,73 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCleanBasePath(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "", true},
+		{"/", "", true},
+		{"tools/ssh", "/tools/ssh", true},
+		{"/tools/ssh/", "/tools/ssh", true},
+		{"/tools//ssh", "/tools/ssh", true},
+		{"/tools/./ssh", "/tools/ssh", true},
+		{"/a..b", "/a..b", true},
+		{"..", "", false},
+		{"/../", "", false},
+		{"/tools/../ssh", "", false},
+		{"/tools/..", "", false},
+		{".", "", false},
+		{"//", "", false},
+		{"/tools?x", "", false},
+		{"/tools#x", "", false},
+		{"/{name}", "", false},
+	}
+	for _, tt := range tests {
+		got, err := CleanBasePath(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("CleanBasePath(%q) = %q, %v, want %q, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMount(t *testing.T) {
+	s := NewWsToTcpServer(context.Background(), "", 0)
+	s.BasePath = "/tools/ssh"
+	page := http.NewServeMux()
+	page.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("page " + r.URL.Path))
+	})
+	h := s.mount(page)
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/tools/ssh/", http.StatusOK, "page /"},
+		{"/tools/ssh/ws/mux", http.StatusOK, "page /ws/mux"},
+		{"/tools/ssh", http.StatusMovedPermanently, ""},
+		{"/healthz", http.StatusOK, "ok\n"},
+		{"/", http.StatusNotFound, ""},
+		{"/ws/mux", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("GET %s: status %d, want %d", tt.path, rec.Code, tt.status)
+		}
+		if len(tt.body) != 0 && rec.Body.String() != tt.body {
+			t.Errorf("GET %s: body %q, want %q", tt.path, rec.Body.String(), tt.body)
+		}
+	}
+}
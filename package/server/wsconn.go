@@ -0,0 +1,198 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultPingInterval = 20 * time.Second
+	defaultPongTimeout  = 10 * time.Second
+	// wsWriteTimeout bounds every frame write, a peer that stops reading
+	// must not pin the tunnel forever.
+	wsWriteTimeout = 10 * time.Second
+	// closeGrace is how long the peer has to answer our close frame.
+	closeGrace = 2 * time.Second
+)
+
+// maxCloseReason is the longest close reason that fits a control frame.
+const maxCloseReason = 123
+
+var errPeerUnresponsive = errors.New("no pong received in time")
+
+// WebSocketConfig tunes the WebSocket side of tunnels.
+type WebSocketConfig struct {
+	// Compression negotiates permessage-deflate with browsers that offer
+	// it. SSH traffic is encrypted and hardly compresses, so it is off by
+	// default.
+	Compression bool `yaml:"compression"`
+	// PingInterval is how often the browser is pinged, 20s when zero.
+	PingInterval time.Duration `yaml:"ping_interval"`
+	// PongTimeout is how long a ping may go unanswered before the peer is
+	// considered dead, 10s when zero.
+	PongTimeout time.Duration `yaml:"pong_timeout"`
+}
+
+func (c *WebSocketConfig) validate() error {
+	if c.PingInterval < 0 || c.PongTimeout < 0 {
+		return fmt.Errorf("websocket: ping_interval and pong_timeout must not be negative")
+	}
+	return nil
+}
+
+func (c *WebSocketConfig) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    4096,
+		WriteBufferSize:   4096,
+		EnableCompression: c.Compression,
+		// The Origin is checked before upgrading, see wsUpgradeHandler.
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+}
+
+func (c *WebSocketConfig) pingInterval() time.Duration {
+	if c.PingInterval > 0 {
+		return c.PingInterval
+	}
+	return defaultPingInterval
+}
+
+func (c *WebSocketConfig) pongTimeout() time.Duration {
+	if c.PongTimeout > 0 {
+		return c.PongTimeout
+	}
+	return defaultPongTimeout
+}
+
+// wsStream adapts a WebSocket connection to the byte stream copyData
+// expects. Incoming data messages are concatenated, every Write is sent as
+// one binary message.
+type wsStream struct {
+	conn *websocket.Conn
+	r    io.Reader
+	// wmu serializes data and control messages, gorilla/websocket allows
+	// one writer at a time.
+	wmu sync.Mutex
+	// alive is how long the peer may stay silent, every frame it sends
+	// (pongs included) extends the read deadline by that much.
+	alive    time.Duration
+	interval time.Duration
+}
+
+func newWsStream(conn *websocket.Conn, cfg WebSocketConfig) *wsStream {
+	alive := cfg.pingInterval() + cfg.pongTimeout()
+	ws := &wsStream{conn: conn, alive: alive, interval: cfg.pingInterval()}
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(alive))
+	})
+	return ws
+}
+
+func (ws *wsStream) Read(p []byte) (int, error) {
+	for {
+		if ws.r == nil {
+			_, r, err := ws.conn.NextReader()
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					return 0, errPeerUnresponsive
+				}
+				return 0, err
+			}
+			ws.conn.SetReadDeadline(time.Now().Add(ws.alive))
+			ws.r = r
+		}
+		n, err := ws.r.Read(p)
+		if err == io.EOF {
+			ws.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (ws *wsStream) Write(p []byte) (int, error) {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := ws.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SetReadDeadline is a no-op: a timed out read breaks a WebSocket
+// connection for good, liveness is tracked with pings instead.
+func (ws *wsStream) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// keepalive starts the liveness clock and pings the peer until done is
+// closed. The clock starts here rather than on upgrade, the dial to the
+// target may take longer than the peer is allowed to stay silent.
+func (ws *wsStream) keepalive(done <-chan struct{}) {
+	ws.conn.SetReadDeadline(time.Now().Add(ws.alive))
+	ping(ws.conn, ws.interval, done)
+}
+
+func (ws *wsStream) sendControl(msg ControlMessage) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return ws.conn.WriteMessage(websocket.TextMessage, msg.marshal())
+}
+
+func (ws *wsStream) sendClose(code int, reason string) error {
+	return writeClose(ws.conn, code, reason)
+}
+
+func (ws *wsStream) Close() error {
+	return ws.conn.Close()
+}
+
+// ping pings the peer every interval until done is closed or a ping cannot
+// be sent.
+func ping(conn *websocket.Conn, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// writeClose sends a close frame carrying code and reason, cut to fit a
+// control frame. It is a no-op once a close frame was sent.
+func writeClose(conn *websocket.Conn, code int, reason string) error {
+	if len(reason) > maxCloseReason {
+		n := maxCloseReason
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+	if errors.Is(err, websocket.ErrCloseSent) {
+		return nil
+	}
+	return err
+}
@@ -7,9 +7,16 @@ import (
 	"context"
 	"embed"
 	"flag"
+	"fmt"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	server "github.com/wrtx-dev/gowasmssh/package/server"
 )
@@ -17,24 +24,253 @@ import (
 //go:embed webpage/dist/*
 var staticFS embed.FS
 
+// version is set at link time, see the server target of the Makefile.
+var version string
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 var addr string
 var port int
+var configFile string
+var checkConfig bool
+var basePath string
+var staticDir string
+var origins stringList
+var devMode bool
+var logLevel string
+var logFile string
+var limits server.LimitConfig
+var timeouts server.TimeoutConfig
+var tlsFiles server.TLSConfig
 
 func init() {
 	flag.StringVar(&addr, "listen", "0.0.0.0", "listen address")
 	flag.IntVar(&port, "port", 9090, "listen port")
+	flag.StringVar(&configFile, "config", "", "path to a YAML config file, reloaded on SIGHUP")
+	flag.BoolVar(&checkConfig, "check", false, "validate the config and exit")
+	flag.StringVar(&basePath, "base-path", "", "URL prefix to serve under, e.g. /tools/ssh")
+	flag.StringVar(&staticDir, "static-dir", "", "serve the web page from this directory instead of the embedded one")
+	flag.Var(&origins, "origin", "allowed Origin, e.g. example.com, *.example.com or https://example.com:8443 (repeatable)")
+	flag.BoolVar(&devMode, "dev", false, "development mode: accept any Origin")
+	flag.StringVar(&logLevel, "log-level", "", "log level: debug, info, warn or error")
+	flag.StringVar(&logFile, "log-file", "", "append JSON logs to this file instead of stderr")
+	flag.Float64Var(&limits.RatePerIP, "rate-per-ip", 0, "new tunnels per second per client IP, 0 for unlimited")
+	flag.IntVar(&limits.BurstPerIP, "burst-per-ip", 0, "burst of new tunnels per client IP")
+	flag.IntVar(&limits.MaxPerIP, "max-per-ip", 0, "max concurrent tunnels per client IP, 0 for unlimited")
+	flag.IntVar(&limits.MaxTotal, "max-tunnels", 0, "max concurrent tunnels in total, 0 for unlimited")
+	flag.StringVar(&tlsFiles.Cert, "tls-cert", "", "TLS certificate file, reloaded when it changes")
+	flag.StringVar(&tlsFiles.Key, "tls-key", "", "TLS private key file")
+	flag.StringVar(&tlsFiles.ClientCA, "tls-client-ca", "", "require client certificates signed by a CA in this PEM bundle")
+	flag.DurationVar(&timeouts.Idle, "idle-timeout", 0, "close tunnels idle for this long, 0 to disable")
+	flag.DurationVar(&timeouts.MaxLifetime, "max-lifetime", 0, "close tunnels open for this long, 0 to disable")
+	flag.DurationVar(&timeouts.Drain, "drain-timeout", 30*time.Second, "on shutdown, wait this long for tunnels to end before closing them")
+}
+
+func loadConfig() (*server.Config, error) {
+	cfg := &server.Config{}
+	if len(configFile) != 0 {
+		c, err := server.LoadConfig(configFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg = c
+	}
+	cfg.Origins.Allow = append(cfg.Origins.Allow, origins...)
+	if devMode {
+		cfg.Origins.AllowAny = true
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "rate-per-ip":
+			cfg.Limits.RatePerIP = limits.RatePerIP
+		case "burst-per-ip":
+			cfg.Limits.BurstPerIP = limits.BurstPerIP
+		case "max-per-ip":
+			cfg.Limits.MaxPerIP = limits.MaxPerIP
+		case "max-tunnels":
+			cfg.Limits.MaxTotal = limits.MaxTotal
+		case "tls-cert":
+			cfg.TLS.Cert = tlsFiles.Cert
+		case "tls-key":
+			cfg.TLS.Key = tlsFiles.Key
+		case "tls-client-ca":
+			cfg.TLS.ClientCA = tlsFiles.ClientCA
+		case "idle-timeout":
+			cfg.Timeouts.Idle = timeouts.Idle
+		case "max-lifetime":
+			cfg.Timeouts.MaxLifetime = timeouts.MaxLifetime
+		case "drain-timeout":
+			cfg.Timeouts.Drain = timeouts.Drain
+		case "base-path":
+			cfg.BasePath = basePath
+		case "static-dir":
+			cfg.StaticDir = staticDir
+		}
+	})
+	var err error
+	if cfg.BasePath, err = server.CleanBasePath(cfg.BasePath); err != nil {
+		return nil, err
+	}
+	if err := server.ValidateListeners(cfg.Listeners); err != nil {
+		return nil, err
+	}
+	if len(logLevel) != 0 {
+		cfg.Log.Level = logLevel
+	}
+	if err := mergeListen(cfg); err != nil {
+		return nil, err
+	}
+	if len(logFile) != 0 {
+		cfg.Log.File = logFile
+	}
+	return cfg, nil
+}
+
+// mergeListen applies -listen and -port to the listen address of cfg.
+func mergeListen(cfg *server.Config) error {
+	host, portStr := "0.0.0.0", "9090"
+	if len(cfg.Listen) != 0 {
+		var err error
+		if host, portStr, err = net.SplitHostPort(cfg.Listen); err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			host = addr
+		case "port":
+			portStr = strconv.Itoa(port)
+		}
+	})
+	if p, err := strconv.Atoi(portStr); err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("listen: bad port %q", portStr)
+	}
+	cfg.Listen = net.JoinHostPort(host, portStr)
+	return nil
 }
+
 func main() {
 	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// run serves until a signal ends it. Its deferred calls, closing the log
+// file among them, have run by the time main exits on its error.
+func run() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("load config err: %w", err)
+	}
+	settings, err := server.NewSettings(cfg)
+	if err != nil {
+		return fmt.Errorf("config err: %w", err)
+	}
+	var certs *server.CertReloader
+	if cfg.TLS.Enabled() {
+		if certs, err = server.NewCertReloader(cfg.TLS); err != nil {
+			return fmt.Errorf("tls err: %w", err)
+		}
+	}
+	if checkConfig {
+		fmt.Println("config ok")
+		return nil
+	}
+	logger, logCloser, err := server.NewLogger(cfg.Log)
+	if err != nil {
+		return fmt.Errorf("log err: %w", err)
+	}
+	defer logCloser.Close()
+	slog.SetDefault(logger)
+
+	host, portStr, _ := net.SplitHostPort(cfg.Listen)
+	port, _ := strconv.Atoi(portStr)
 	ctx, cancel := context.WithCancel(context.Background())
-	server := server.NewWsToTcpServer(ctx, addr, port)
+	server := server.NewWsToTcpServer(ctx, host, port)
+	server.TLS = certs
+	server.MetricsAddr = cfg.Metrics.Listen
+	server.AdminAddr = cfg.Admin.Listen
+	server.Logger = logger
+	server.Version = version
+	server.Listeners = cfg.Listeners
+	server.BasePath = cfg.BasePath
+	server.StaticDir = cfg.StaticDir
+	server.Apply(settings)
+	done := make(chan struct{})
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
+		defer close(done)
 		defer cancel()
-		sigchan := make(chan os.Signal, 1)
-		signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigchan
-		server.Shutdown()
+		handleSignals(sigchan, server, certs, cfg)
 	}()
 
-	server.Serve(staticFS)
+	if err := server.Serve(staticFS); err != nil {
+		return fmt.Errorf("serve err: %w", err)
+	}
+	// Serve returns as soon as the listeners close, wait for the drain.
+	<-done
+	return nil
+}
+
+// handleSignals reloads the config on SIGHUP until another signal arrives,
+// then shuts srv down.
+func handleSignals(sigchan <-chan os.Signal, srv *server.WsToTcpServer, certs *server.CertReloader, cfg *server.Config) {
+	for sig := range sigchan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		cfg = reload(srv, certs, cfg)
+	}
+	srv.Shutdown()
+}
+
+// reload reads the config file again and applies it to srv. Open tunnels
+// are kept. On error the running config stays in effect. It returns the
+// config now in effect.
+func reload(srv *server.WsToTcpServer, certs *server.CertReloader, running *server.Config) *server.Config {
+	cfg, err := loadConfig()
+	if err == nil {
+		var settings *server.Settings
+		if settings, err = server.NewSettings(cfg); err == nil {
+			srv.Apply(settings)
+		}
+	}
+	if err != nil {
+		slog.Error("config reload failed, keeping the running config", "error", err)
+		return running
+	}
+	if certs != nil {
+		if err := certs.Reload(); err != nil {
+			slog.Error("tls reload failed, keeping the current certificate", "error", err)
+		}
+	}
+	for key, changed := range map[string]bool{
+		"listen":         cfg.Listen != running.Listen,
+		"listeners":      !slices.Equal(cfg.Listeners, running.Listeners),
+		"tls":            cfg.TLS != running.TLS,
+		"metrics.listen": cfg.Metrics.Listen != running.Metrics.Listen,
+		"admin.listen":   cfg.Admin.Listen != running.Admin.Listen,
+		"log.file":       cfg.Log.File != running.Log.File,
+		"base_path":      cfg.BasePath != running.BasePath,
+		"static_dir":     cfg.StaticDir != running.StaticDir,
+	} {
+		if changed {
+			slog.Warn("config change needs a restart to take effect", "key", key)
+		}
+	}
+	slog.Info("config reloaded", "file", configFile)
+	return cfg
 }
@@ -0,0 +1,107 @@
+//go:build !wasm && !js
+// +build !wasm,!js
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	server "github.com/wrtx-dev/gowasmssh/package/server"
+)
+
+func TestReload(t *testing.T) {
+	configFile = filepath.Join(t.TempDir(), "config.yaml")
+	defer func() { configFile = "" }()
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("listen: 127.0.0.1:9000\nlimits:\n  max_total: 10\n")
+	running, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := server.NewSettings(running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.NewWsToTcpServer(context.Background(), "127.0.0.1", 9000)
+	srv.Apply(settings)
+
+	write("listen: 127.0.0.1:9001\nlimits:\n  max_total: 20\n")
+	cfg := reload(srv, nil, running)
+	if cfg == running || cfg.Limits.MaxTotal != 20 || cfg.Listen != "127.0.0.1:9001" {
+		t.Errorf("reload returned %+v, want the new config", cfg)
+	}
+
+	for _, data := range []string{"limits:\n  max_total: -1\n", "limits: [\n", "lsiten: 127.0.0.1:9002\n"} {
+		write(data)
+		if got := reload(srv, nil, cfg); got != cfg {
+			t.Errorf("reload of %q returned %+v, want the running config", data, got)
+		}
+	}
+	os.Remove(configFile)
+	if got := reload(srv, nil, cfg); got != cfg {
+		t.Errorf("reload without the file returned %+v, want the running config", got)
+	}
+}
+
+func TestHandleSignals(t *testing.T) {
+	configFile = filepath.Join(t.TempDir(), "config.yaml")
+	defer func() { configFile = "" }()
+	if err := os.WriteFile(configFile, []byte("log:\n  level: info\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	running, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := server.NewSettings(running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.NewWsToTcpServer(context.Background(), "127.0.0.1", 0)
+	srv.Apply(settings)
+	logger, closer, err := server.NewLogger(server.LogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGHUP, syscall.SIGTERM)
+	defer signal.Stop(sigchan)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleSignals(sigchan, srv, nil, running)
+	}()
+
+	if err := os.WriteFile(configFile, []byte("log:\n  level: debug\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	for deadline := time.Now().Add(5 * time.Second); !logger.Enabled(context.Background(), slog.LevelDebug); {
+		if time.Now().After(deadline) {
+			t.Fatal("SIGHUP did not apply the new log level")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM did not shut the server down")
+	}
+}
@@ -4,9 +4,13 @@
 package ssh
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	neturl "net/url"
+	"strings"
 	"sync"
 
 	"github.com/pkg/sftp"
@@ -16,12 +20,15 @@ import (
 )
 
 type SSHClient struct {
-	session         *ssh.Session
-	url             string
-	modes           *ssh.TerminalModes
-	conn            net.Conn
-	host            string
-	port            int
+	session *ssh.Session
+	url     string
+	modes   *ssh.TerminalModes
+	conn    net.Conn
+	host    string
+	port    int
+	// target is the name of a target of the proxy's catalog, used instead
+	// of host and port when set.
+	target          string
 	term            js.JsValue
 	user            string
 	password        string
@@ -38,6 +45,10 @@ type SSHClient struct {
 	sessionInput    js.JsValue
 	sftp            *sftp.Client
 	cretaeSftp      bool
+	ticket          js.JsValue
+	// mux shares one WebSocket with the other connections to the proxy,
+	// see jsSetMultiplex.
+	mux bool
 }
 
 func (c *SSHClient) close() {
@@ -85,24 +96,167 @@ func (c *SSHClient) genAuthModes() error {
 	return nil
 }
 
+// defaultProxyURL is the tunnel endpoint of the server that served the
+// page, under the base path env.js reports.
+func defaultProxyURL() string {
+	location := js.Global().Get("location")
+	base := js.Global().Get("window").Get("gowasmsshBasePath")
+	url := "ws://" + location.Get("host").String()
+	if base.Type().String() == "string" {
+		url += base.String()
+	}
+	return url + "/ws"
+}
+
 func (c *SSHClient) connectTo() error {
 	var url string
+	secure := js.Global().Get("location").Get("protocol").String() == "https:"
 	ph := js.Global().Get("window").Get("privateProxyLocation")
 	if !ph.IsUndefined() {
 		url = "ws://" + ph.String()
-	} else {
+	} else if len(c.url) != 0 {
 		url = c.url
+	} else {
+		url = defaultProxyURL()
+	}
+	// Browsers refuse plain ws:// from an https page, so upgrade it.
+	if secure && strings.HasPrefix(url, "ws://") {
+		url = "wss://" + strings.TrimPrefix(url, "ws://")
+	}
+	ticket, err := c.resolveTicket()
+	if err != nil {
+		return fmt.Errorf("failed to get connection ticket: %v", err)
+	}
+	// Share one WebSocket with the other connections to the proxy when
+	// asked to, fall back to a WebSocket of our own if it can't multiplex.
+	if c.mux {
+		var conn net.Conn
+		if c.target != "" {
+			conn, err = js.DialMuxTarget(context.Background(), url, c.target, ticket)
+		} else {
+			conn, err = js.DialMux(context.Background(), url, c.host, c.port, ticket)
+		}
+		if err == nil {
+			c.conn = conn
+			c.watchDrain(conn)
+			return nil
+		}
+		var pe *js.ProxyError
+		if errors.As(err, &pe) {
+			return errors.New(proxyErrorText(pe))
+		}
+		if !errors.Is(err, js.ErrMuxUnavailable) {
+			return fmt.Errorf("failed to connect to: %v err: %v", c.url, err)
+		}
+	}
+	if c.target != "" {
+		url = fmt.Sprintf("%s/alias/%s", url, neturl.PathEscape(c.target))
+	} else {
+		url = fmt.Sprintf("%s/%s/%d", url, c.host, c.port)
+	}
+	if ticket != "" {
+		url += "?ticket=" + neturl.QueryEscape(ticket)
 	}
-	url = fmt.Sprintf("%s/%s/%d", url, c.host, c.port)
 	conn, err := js.Dial(url)
 	if err != nil {
 		return fmt.Errorf("failed to connect to: %v err: %v", c.url, err)
 	}
 	c.url = url
 	c.conn = conn
+	c.watchDrain(conn)
 	return nil
 }
 
+// watchDrain tells the user when the proxy announces it is shutting down,
+// so the session can be saved and reopened before the proxy closes it.
+func (c *SSHClient) watchDrain(conn net.Conn) {
+	d, ok := conn.(interface{ OnDraining(func(*js.Draining)) })
+	if !ok {
+		return
+	}
+	d.OnDraining(func(notice *js.Draining) {
+		msg := notice.Message
+		if notice.CloseIn > 0 {
+			msg = fmt.Sprintf("%s, the session will be closed in %s", msg, notice.CloseIn)
+		}
+		c.warnning(msg)
+	})
+}
+
+// resolveTicket returns the connection ticket for the current target. The
+// ticket is either set with setTicket or taken from
+// window.privateProxyTicket, and may be a string or a function called with
+// (host, port), or (name) for a catalog target, that returns a string or a
+// promise of one.
+func (c *SSHClient) resolveTicket() (string, error) {
+	t := c.ticket
+	if t.IsUndefined() || t.IsNull() {
+		t = js.Global().Get("window").Get("privateProxyTicket")
+	}
+	if t.IsUndefined() || t.IsNull() {
+		return "", nil
+	}
+	if t.Type().String() == "function" {
+		if c.target != "" {
+			t = t.Invoke(c.target)
+		} else {
+			t = t.Invoke(c.host, c.port)
+		}
+	}
+	if t.Type().String() == "object" && t.Get("then").Type().String() == "function" {
+		res, err := js.JsValueAwait(t)
+		if err != nil {
+			return "", err
+		}
+		if len(res) == 0 {
+			return "", nil
+		}
+		t = res[0]
+	}
+	if t.Type().String() != "string" {
+		return "", fmt.Errorf("ticket must be a string, got %s", t.Type().String())
+	}
+	return t.String(), nil
+}
+
+// proxyError returns the error the proxy reported on conn, if any.
+func proxyError(conn net.Conn) *js.ProxyError {
+	c, ok := conn.(interface{ ProxyError() *js.ProxyError })
+	if !ok {
+		return nil
+	}
+	return c.ProxyError()
+}
+
+// proxyErrorText is what the user is told about an error the proxy
+// reported.
+func proxyErrorText(pe *js.ProxyError) string {
+	if pe.RetryAfter > 0 {
+		return fmt.Sprintf("%s, try again in %s", pe.Message, pe.RetryAfter)
+	}
+	return pe.Message
+}
+
+// proxyCloseMessage returns the proxy's reason when it ended the session on
+// its own, e.g. because of its idle timeout or a shutdown.
+func proxyCloseMessage(conn net.Conn) (string, bool) {
+	if pe := proxyError(conn); pe != nil {
+		return proxyErrorText(pe), true
+	}
+	ws, ok := conn.(interface{ CloseError() *js.CloseError })
+	if !ok {
+		return "", false
+	}
+	ce := ws.CloseError()
+	if ce == nil || !ce.ServerClosed() {
+		return "", false
+	}
+	if len(ce.Reason) == 0 {
+		return ce.Error(), true
+	}
+	return ce.Reason, true
+}
+
 func (c *SSHClient) disconnect(_ js.JsValue, args []js.JsValue) interface{} {
 	go func() {
 		c.close()
@@ -161,6 +315,24 @@ func (c *SSHClient) jsSetHostInfo(_ js.JsValue, args []js.JsValue) interface{} {
 	return nil
 }
 
+// jsSetTarget connects to the target the proxy's catalog calls name
+// instead of a host and port.
+func (c *SSHClient) jsSetTarget(_ js.JsValue, args []js.JsValue) interface{} {
+	if len(args) < 1 || args[0].Type().String() != "string" {
+		return js.Global().Get("error").New("need target name")
+	}
+	c.target = args[0].String()
+	return nil
+}
+
+// dest names what the client connects to in messages.
+func (c *SSHClient) dest() string {
+	if c.target != "" {
+		return c.target
+	}
+	return c.host
+}
+
 func (c *SSHClient) jsSetUserPassword(_ js.JsValue, args []js.JsValue) interface{} {
 	if len(args) < 2 {
 		return js.Global().Get("error").New("need user, password ")
@@ -186,6 +358,25 @@ func (c *SSHClient) jsSetTerminal(_ js.JsValue, args []js.JsValue) interface{} {
 	return nil
 }
 
+func (c *SSHClient) jsSetTicket(_ js.JsValue, args []js.JsValue) interface{} {
+	if len(args) < 1 {
+		return js.Global().Get("error").New("need ticket string or function")
+	}
+	c.ticket = args[0]
+	return nil
+}
+
+// jsSetMultiplex turns sharing one WebSocket between connections on or
+// off. It is off by default: proxies without /ws/mux, such as the
+// Cloudflare worker, would cost every connection a failed handshake first.
+func (c *SSHClient) jsSetMultiplex(_ js.JsValue, args []js.JsValue) interface{} {
+	if len(args) < 1 || args[0].Type().String() != "boolean" {
+		return js.Global().Get("error").New("need a boolean")
+	}
+	c.mux = args[0].Bool()
+	return nil
+}
+
 func (c *SSHClient) jsSetPrivateKey(_ js.JsValue, args []js.JsValue) interface{} {
 	if len(args) < 1 {
 		return js.Global().Get("error").New("need private key")
@@ -227,7 +418,7 @@ func (c *SSHClient) jsSSHFunc(_ js.JsValue, args []js.JsValue) interface{} {
 		}
 
 		if err := c.connectTo(); err != nil {
-			c.errorMsg(fmt.Sprintf("connect to host %s err: %v", c.host, err))
+			c.errorMsg(fmt.Sprintf("connect to host %s err: %v", c.dest(), err))
 			return
 		}
 
@@ -261,9 +452,13 @@ func (c *SSHClient) jsSSHFunc(_ js.JsValue, args []js.JsValue) interface{} {
 			Auth:            c.auth,
 			HostKeyCallback: hostKeyCallback,
 		}
-		sc, nc, r, err := ssh.NewClientConn(c.conn, c.host, sshConf)
+		sc, nc, r, err := ssh.NewClientConn(c.conn, c.dest(), sshConf)
 		if err != nil {
-			c.errorMsg(fmt.Sprintf("failed to open ssh connection: %v", err))
+			if pe := proxyError(c.conn); pe != nil {
+				c.errorMsg(fmt.Sprintf("connect to host %s failed: %s", c.dest(), proxyErrorText(pe)))
+			} else {
+				c.errorMsg(fmt.Sprintf("failed to open ssh connection: %v", err))
+			}
 			if sc != nil {
 				sc.Close()
 			}
@@ -285,6 +480,7 @@ func (c *SSHClient) jsSSHFunc(_ js.JsValue, args []js.JsValue) interface{} {
 			c.errorMsg(fmt.Sprintf("failed to open stdout: %v", err))
 			return
 		}
+		conn := c.conn
 		go func() {
 			ob := make([]byte, 2048)
 			for {
@@ -292,6 +488,8 @@ func (c *SSHClient) jsSSHFunc(_ js.JsValue, args []js.JsValue) interface{} {
 				if err != nil {
 					if err != io.EOF {
 						c.breakWithMsg("Error!!!!", fmt.Sprintf("connection closed: %v", err))
+					} else if msg, ok := proxyCloseMessage(conn); ok {
+						c.breakWithMsg("Session closed", msg)
 					} else {
 						c.close()
 					}
@@ -411,10 +609,13 @@ func SSHNewConnection(this js.JsValue, args []js.JsValue) interface{} {
 	sshClient.Set("disconnect", js.JsFuncOf(c.disconnect))
 	sshClient.Set("resize", js.JsFuncOf(c.resize))
 	sshClient.Set("setHostInfo", js.JsFuncOf(c.jsSetHostInfo))
+	sshClient.Set("setTarget", js.JsFuncOf(c.jsSetTarget))
 	sshClient.Set("setUserPassword", js.JsFuncOf(c.jsSetUserPassword))
 	sshClient.Set("setShowFingerPrint", js.JsFuncOf(c.jsSetShowFingerPrint))
 	sshClient.Set("setTerminal", js.JsFuncOf(c.jsSetTerminal))
 	sshClient.Set("setPrivateKey", js.JsFuncOf(c.jsSetPrivateKey))
+	sshClient.Set("setTicket", js.JsFuncOf(c.jsSetTicket))
+	sshClient.Set("setMultiplex", js.JsFuncOf(c.jsSetMultiplex))
 	sshClient.Set("setCallback", js.JsFuncOf(c.jsSetCallback))
 	sshClient.Set("sessionInput", js.JsFuncOf(c.jsSessionInput))
 	sshClient.Set("sftClient", js.JsFuncOf(c.jsGetSFTClient))
@@ -0,0 +1,3 @@
+// The proxy server replaces this file to pass the base path it is served
+// under, see package/server/web.go.
+window.gowasmsshBasePath = "";
@@ -9,7 +9,9 @@ import SearchImg from "./assets/search.svg";
 import Down from "./assets/downfill.svg"
 import { useCallback } from 'react';
 
-const defaultProxy = window.location.protocol === "https:" ? "wss://" + window.location.host + "/ws" : "ws://" + window.location.host + "/ws";
+// env.js sets the base path when the proxy is served under a prefix.
+const basePath = window.gowasmsshBasePath || "";
+const defaultProxy = (window.location.protocol === "https:" ? "wss://" : "ws://") + window.location.host + basePath + "/ws";
 
 export function App() {
 	const ref = useRef(null);
@@ -30,6 +32,26 @@ export function App() {
 	const [ignoreCase, setIgnoreCase] = useState(true);
 	const [fullWordMatch, setFullWordMatch] = useState(false);
 	const [findData, setFindData] = useState("");
+	// Named targets of the proxy, see GET /targets.
+	const [targets, setTargets] = useState([]);
+	const [allowAddresses, setAllowAddresses] = useState(true);
+	const [target, setTarget] = useState("");
+
+	useEffect(() => {
+		fetch(`${basePath}/targets`)
+			.then((res) => res.ok ? res.json() : null)
+			.then((data) => {
+				if (!data) {
+					return;
+				}
+				setTargets(data.targets || []);
+				setAllowAddresses(data.allow_addresses !== false);
+				if (data.allow_addresses === false && data.targets && data.targets.length > 0) {
+					setTarget(data.targets[0].name);
+				}
+			})
+			.catch(() => { });
+	}, []);
 
 	const sftpItemClick = (file) => {
 		if (file.isDir && sftpRef && sftpRef.current) {
@@ -70,13 +92,18 @@ export function App() {
 		const passphrase = formData.get('Passphrase');
 		const finger = formData.get("finger");
 		const createSftp = formData.get("usesftp");
+		const targetName = formData.get("target");
 
 
 		dialogRef.current.close();
 		// @ts-ignore
 		const client = sshNewConnection(proxy);
 		clientRef.current = client;
-		client.setHostInfo(host.toString(), parseInt(port.toString()));
+		if (targetName) {
+			client.setTarget(targetName.toString());
+		} else {
+			client.setHostInfo(host.toString(), parseInt(port.toString()));
+		}
 		client.setUserPassword(username, password);
 		client.setTerminal(term.current);
 		client.setShowFingerPrint(finger === "on");
@@ -281,7 +308,25 @@ export function App() {
 						onSubmit={connectHandler}
 					>
 
-						<div className={"grid grid-cols-2 gap-1"}>
+						{/*target*/}
+						{targets.length > 0 && <div className={"join rounded-sm gap-0.5 input border-black focus-within:border-black focus-within:outline-0 focus-within:ring-0 items-center w-full"}>
+							<label className={"label join-item"}>目标</label>
+							<select
+								className={"select join-item border-none focus-within:border-none focus-within:outline-0 focus-within:ring-0 px-1"}
+								name={"target"}
+								value={target}
+								onChange={(e) => setTarget(e.currentTarget.value)}
+							>
+								{allowAddresses && <option value={""}>手动输入主机</option>}
+								{targets.map((t) => (
+									<option value={t.name} key={t.name}>
+										{t.description ? `${t.name} - ${t.description}` : t.name}
+									</option>
+								))}
+							</select>
+						</div>}
+
+						{!target && <div className={"grid grid-cols-2 gap-1"}>
 							{/*host*/}
 							<div className={"col-span-1 join rounded-sm gap-0.5 input border-black focus-within:border-black focus-within:outline-0 focus-within:ring-0 items-center w-full"}>
 								<label className={"label join-item"}>主机地址</label>
@@ -301,7 +346,7 @@ export function App() {
 									name={"port"}
 								/>
 							</div>
-						</div>
+						</div>}
 
 
 						<div className={"grid grid-cols-2 gap-1"}>
@@ -4,6 +4,8 @@ import tailwindcss from '@tailwindcss/vite';
 
 // https://vitejs.dev/config/
 export default defineConfig({
+	// Relative asset URLs, so the page works under any base path.
+	base: './',
 	plugins: [
 		preact(),
 		tailwindcss()